@@ -0,0 +1,278 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Formats accepted by the archive query parameter on directories.
+const (
+	archiveZip   = "zip"
+	archiveTar   = "tar"
+	archiveTarGz = "tar.gz"
+)
+
+var archiveContentTypes = map[string]string{
+	archiveZip:   "application/zip",
+	archiveTar:   "application/x-tar",
+	archiveTarGz: "application/gzip",
+}
+
+type ArchiveOptions struct {
+	Format  string
+	Include []string // globs a file's name or relative path must match, any if empty
+	Exclude []string // globs that leave out matching files and directories
+	Entries []string // paths relative to the directory to archive, all if empty
+}
+
+func parseArchiveOptions(query url.Values) (ArchiveOptions, error) {
+	opts := ArchiveOptions{Format: query.Get("archive"), Include: query["include"], Exclude: query["exclude"]}
+	if _, ok := archiveContentTypes[opts.Format]; !ok {
+		return opts, newError(codeBadRequest, "Unknown archive format %s", opts.Format)
+	}
+	for _, glob := range slices.Concat(opts.Include, opts.Exclude) {
+		if _, err := path.Match(glob, ""); err != nil {
+			return opts, newError(codeBadRequest, "Invalid glob %s", glob)
+		}
+	}
+	for _, entry := range query["entry"] {
+		clean := path.Clean(entry)
+		if !fs.ValidPath(clean) || clean == "." || slices.ContainsFunc(strings.Split(clean, "/"), isHiddenEntry) {
+			return opts, newError(codeBadRequest, "Invalid entry %s", entry)
+		}
+		opts.Entries = append(opts.Entries, clean)
+	}
+	return opts, nil
+}
+
+// matchesArchiveGlob reports whether any glob matches the entry's name or its
+// path relative to the directory being archived.
+func matchesArchiveGlob(globs []string, rel string) bool {
+	for _, glob := range globs {
+		if matched, _ := path.Match(glob, path.Base(rel)); matched {
+			return true
+		}
+		if matched, _ := path.Match(glob, rel); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveWriter adds entries to one of the archive formats.
+type archiveWriter interface {
+	addDir(name string, info os.FileInfo) error
+	addFile(name string, info os.FileInfo, file io.Reader) error
+	Close() error
+}
+
+type zipArchiveWriter struct{ *zip.Writer }
+
+func (z zipArchiveWriter) addDir(name string, info os.FileInfo) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name + "/"
+	header.Method = zip.Store
+	_, err = z.CreateHeader(header)
+	return err
+}
+
+func (z zipArchiveWriter) addFile(name string, info os.FileInfo, file io.Reader) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	// media is compressed already, so deflating it again only costs time
+	if t := mime.TypeByExtension(path.Ext(name)); strings.HasPrefix(t, "video/") || strings.HasPrefix(t, "audio/") || strings.HasPrefix(t, "image/") {
+		header.Method = zip.Store
+	}
+	w, err := z.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, file)
+	return err
+}
+
+type tarArchiveWriter struct {
+	*tar.Writer
+	gzip *gzip.Writer // only for tar.gz
+}
+
+func (t tarArchiveWriter) addDir(name string, info os.FileInfo) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name + "/"
+	return t.WriteHeader(header)
+}
+
+func (t tarArchiveWriter) addFile(name string, info os.FileInfo, file io.Reader) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	err = t.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(t.Writer, file, info.Size())
+	return err
+}
+
+func (t tarArchiveWriter) Close() error {
+	err := t.Writer.Close()
+	if t.gzip != nil {
+		err = errors.Join(err, t.gzip.Close())
+	}
+	return err
+}
+
+func newArchiveWriter(format string, w io.Writer) archiveWriter {
+	switch format {
+	case archiveTar:
+		return tarArchiveWriter{Writer: tar.NewWriter(w)}
+	case archiveTarGz:
+		gz := gzip.NewWriter(w)
+		return tarArchiveWriter{Writer: tar.NewWriter(gz), gzip: gz}
+	}
+	return zipArchiveWriter{zip.NewWriter(w)}
+}
+
+// addArchiveTree adds roots, relative to the directory at fullPath, and
+// everything below them to archive under a folder named prefix. If wrap is
+// given, every file is read through it.
+func addArchiveTree(archive archiveWriter, fullPath string, prefix string, roots []string, opts ArchiveOptions, wrap func(io.Reader) io.Reader) error {
+	for _, root := range roots {
+		walkErr := filepath.WalkDir(filepath.Join(fullPath, filepath.FromSlash(root)), func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, relErr := filepath.Rel(fullPath, p)
+			if relErr != nil {
+				return relErr
+			}
+			rel = filepath.ToSlash(rel)
+			if isHiddenEntry(d.Name()) || (rel != "." && matchesArchiveGlob(opts.Exclude, rel)) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			// symlinks are left out rather than followed out of the root
+			if !d.IsDir() && !d.Type().IsRegular() {
+				return nil
+			}
+			entryInfo, infoErr := d.Info()
+			if infoErr != nil {
+				return infoErr
+			}
+			name := path.Join(prefix, rel)
+			if d.IsDir() {
+				return archive.addDir(name, entryInfo)
+			}
+			if len(opts.Include) > 0 && !matchesArchiveGlob(opts.Include, rel) {
+				return nil
+			}
+			file, openErr := os.Open(p)
+			if openErr != nil {
+				return openErr
+			}
+			defer file.Close()
+			var r io.Reader = file
+			if wrap != nil {
+				r = wrap(file)
+			}
+			return archive.addFile(name, entryInfo, r)
+		})
+		if walkErr != nil {
+			return walkErr
+		}
+	}
+	return nil
+}
+
+// errArchiveCancelled stops an archive part way through once nobody is reading it.
+var errArchiveCancelled = errors.New("archive download cancelled")
+
+// chunkWriter sends whatever is written to it down a channel, until done is closed.
+type chunkWriter struct {
+	c    chan<- []byte
+	done <-chan struct{}
+}
+
+func (w chunkWriter) Write(p []byte) (int, error) {
+	chunk := make([]byte, len(p))
+	copy(chunk, p)
+	select {
+	case w.c <- chunk:
+		return len(p), nil
+	case <-w.done:
+		return 0, errArchiveCancelled
+	}
+}
+
+// WriteArchive streams the directory at fullPath as an archive in chunks of
+// roughly chunkSize, with every entry under a folder named after the directory.
+// The archive is built as it is sent, so nothing is written to disk, and it
+// stops as soon as done is closed.
+func WriteArchive(fullPath string, virtualPath string, opts ArchiveOptions, done <-chan struct{}, cArchive chan<- []byte, cErr chan<- error, chunkSize int) {
+	defer close(cErr)
+
+	info, statErr := os.Stat(fullPath)
+	if statErr != nil {
+		close(cArchive)
+		cErr <- fmt.Errorf("Error reading directory: %w", statErr)
+		return
+	}
+	if !info.IsDir() {
+		close(cArchive)
+		cErr <- newError(codeBadRequest, "%s is not a directory", virtualPath)
+		return
+	}
+	roots := []string{"."}
+	if len(opts.Entries) > 0 {
+		roots = opts.Entries
+	}
+	for _, root := range roots {
+		if _, err := os.Lstat(filepath.Join(fullPath, filepath.FromSlash(root))); err != nil {
+			close(cArchive)
+			cErr <- fmt.Errorf("Error reading entry %s: %w", root, err)
+			return
+		}
+	}
+
+	buffered := bufio.NewWriterSize(chunkWriter{c: cArchive, done: done}, chunkSize)
+	archive := newArchiveWriter(opts.Format, buffered)
+	err := addArchiveTree(archive, fullPath, path.Base(virtualPath), roots, opts, nil)
+	if err == nil {
+		err = errors.Join(archive.Close(), buffered.Flush())
+	}
+	close(cArchive)
+	if errors.Is(err, errArchiveCancelled) {
+		filesLog.Info("archive cancelled", "path", virtualPath)
+		return
+	}
+	if err != nil {
+		cErr <- fmt.Errorf("Error writing archive: %w", err)
+	}
+}
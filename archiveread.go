@@ -0,0 +1,330 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"cmp"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// browsableArchives are the archives that can be read as directories, by
+// file extension.
+var browsableArchives = []string{".zip", ".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tbz2"}
+
+func isBrowsableArchive(name string) bool {
+	name = strings.ToLower(name)
+	return slices.ContainsFunc(browsableArchives, func(ext string) bool {
+		return strings.HasSuffix(name, ext)
+	})
+}
+
+// splitArchivePath finds the archive that path points into, returning the
+// archive's real path and the member's path inside it. With browse set, an
+// archive addressed directly is read as a directory too. Paths with no
+// archive's name in them are ruled out before touching the disk, as nearly
+// every read goes through here.
+func splitArchivePath(fullPath string, browse bool) (string, string, bool) {
+	p := filepath.Clean(fullPath)
+	if !slices.ContainsFunc(strings.Split(p, string(filepath.Separator)), isBrowsableArchive) {
+		return "", "", false
+	}
+	member := []string{}
+	for {
+		info, err := os.Stat(p)
+		if err == nil {
+			if !info.Mode().IsRegular() || !isBrowsableArchive(p) {
+				return "", "", false
+			}
+			if len(member) == 0 && !browse && !strings.HasSuffix(fullPath, "/") {
+				return "", "", false
+			}
+			slices.Reverse(member)
+			return p, strings.Join(member, "/"), true
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return "", "", false
+		}
+		member = append(member, filepath.Base(p))
+		p = parent
+	}
+}
+
+type archiveMember struct {
+	name string // slash separated path inside the archive
+	info fs.FileInfo
+}
+
+// archiveDirInfo stands in for directories that an archive only implies by
+// the paths of its files.
+type archiveDirInfo struct {
+	name     string
+	modified time.Time
+}
+
+func (d archiveDirInfo) Name() string       { return d.name }
+func (d archiveDirInfo) Size() int64        { return 0 }
+func (d archiveDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (d archiveDirInfo) ModTime() time.Time { return d.modified }
+func (d archiveDirInfo) IsDir() bool        { return true }
+func (d archiveDirInfo) Sys() any           { return nil }
+
+// archiveIndex is the tree of members in an archive, built once from its
+// headers and kept while the archive is unchanged.
+type archiveIndex struct {
+	modified int64
+	size     int64
+	members  map[string]archiveMember
+	children map[string][]string // directory path, "" for the top, to member paths
+}
+
+// archiveIndexMaxEntries bounds the archive index cache, which is simply
+// emptied when it fills up. It is set from the config.
+var archiveIndexMaxEntries = 64
+
+var archiveIndexCacheLock = sync.RWMutex{}
+var archiveIndexCache = map[string]archiveIndex{}
+
+func getArchiveIndex(archivePath string) (archiveIndex, error) {
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return archiveIndex{}, fmt.Errorf("Error reading archive: %w", err)
+	}
+	archiveIndexCacheLock.RLock()
+	cached, ok := archiveIndexCache[archivePath]
+	archiveIndexCacheLock.RUnlock()
+	if ok && cached.modified == info.ModTime().UnixNano() && cached.size == info.Size() {
+		return cached, nil
+	}
+
+	index := archiveIndex{modified: info.ModTime().UnixNano(), size: info.Size(), members: map[string]archiveMember{}, children: map[string][]string{}}
+	add := func(name string, memberInfo fs.FileInfo) {
+		if _, exists := index.members[name]; !exists {
+			parent := path.Dir(name)
+			if parent == "." {
+				parent = ""
+			}
+			index.children[parent] = append(index.children[parent], name)
+		}
+		index.members[name] = archiveMember{name: name, info: memberInfo}
+	}
+	walkErr := walkArchive(archivePath, func(name string, memberInfo fs.FileInfo, _ io.Reader) (bool, error) {
+		add(name, memberInfo)
+		return true, nil
+	})
+	if walkErr != nil {
+		return archiveIndex{}, walkErr
+	}
+	// archives don't have to list the directories their files are in
+	for name := range index.members {
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if _, exists := index.members[dir]; exists {
+				break
+			}
+			add(dir, archiveDirInfo{name: path.Base(dir), modified: info.ModTime()})
+		}
+	}
+
+	archiveIndexCacheLock.Lock()
+	if len(archiveIndexCache) >= archiveIndexMaxEntries {
+		archiveIndexCache = map[string]archiveIndex{}
+	}
+	archiveIndexCache[archivePath] = index
+	archiveIndexCacheLock.Unlock()
+	return index, nil
+}
+
+// cleanMemberName turns a name from an archive header into a relative path,
+// or returns false if there is nothing left of it.
+func cleanMemberName(name string) (string, bool) {
+	name = strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(name, `\`, "/")), "/")
+	return name, name != ""
+}
+
+// walkArchive calls fn with every file and directory in the archive at
+// archivePath, and a reader for its contents, until fn returns false.
+func walkArchive(archivePath string, fn func(name string, info fs.FileInfo, r io.Reader) (bool, error)) error {
+	if strings.HasSuffix(strings.ToLower(archivePath), ".zip") {
+		zipReader, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return fmt.Errorf("Error reading archive: %w", err)
+		}
+		defer zipReader.Close()
+		for _, f := range zipReader.File {
+			name, ok := cleanMemberName(f.Name)
+			if !ok {
+				continue
+			}
+			var r io.ReadCloser = io.NopCloser(strings.NewReader(""))
+			if !f.FileInfo().IsDir() {
+				r, err = f.Open()
+				if err != nil {
+					return fmt.Errorf("Error reading archive: %w", err)
+				}
+			}
+			more, fnErr := fn(name, f.FileInfo(), r)
+			r.Close()
+			if fnErr != nil || !more {
+				return fnErr
+			}
+		}
+		return nil
+	}
+
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("Error reading archive: %w", err)
+	}
+	defer file.Close()
+	var r io.Reader = file
+	lower := strings.ToLower(archivePath)
+	switch {
+	case strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz"):
+		gz, gzErr := gzip.NewReader(file)
+		if gzErr != nil {
+			return fmt.Errorf("Error reading archive: %w", gzErr)
+		}
+		defer gz.Close()
+		r = gz
+	case strings.HasSuffix(lower, ".bz2") || strings.HasSuffix(lower, ".tbz2"):
+		r = bzip2.NewReader(file)
+	}
+	tarReader := tar.NewReader(r)
+	for {
+		header, headerErr := tarReader.Next()
+		if errors.Is(headerErr, io.EOF) {
+			return nil
+		}
+		if headerErr != nil {
+			return fmt.Errorf("Error reading archive: %w", headerErr)
+		}
+		// links and devices have nothing to read, so only files and directories are shown
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeDir {
+			continue
+		}
+		name, ok := cleanMemberName(header.Name)
+		if !ok {
+			continue
+		}
+		more, fnErr := fn(name, header.FileInfo(), tarReader)
+		if fnErr != nil || !more {
+			return fnErr
+		}
+	}
+}
+
+// readArchive sends the member at member inside the archive at archivePath,
+// as a listing if it is a directory or as its contents if it is a file. The
+// archive is never extracted; a file is read straight out of it.
+func readArchive(archivePath string, member string, virtualPath string, cDir chan<- string, cFile chan<- []byte, chunkSize int) error {
+	index, err := getArchiveIndex(archivePath)
+	if err != nil {
+		close(cDir)
+		close(cFile)
+		return err
+	}
+	found, ok := index.members[member]
+	if member != "" && !ok {
+		close(cDir)
+		close(cFile)
+		return newError(codeNotFound, "Path %s not found!", virtualPath)
+	}
+
+	if member == "" || found.info.IsDir() {
+		close(cFile)
+		defer close(cDir)
+		children := slices.Clone(index.children[member])
+		slices.SortFunc(children, func(a, b string) int {
+			aDir, bDir := index.members[a].info.IsDir(), index.members[b].info.IsDir()
+			if aDir != bDir {
+				if aDir {
+					return -1
+				}
+				return 1
+			}
+			return cmp.Compare(a, b)
+		})
+		entries := []json.RawMessage{}
+		for _, child := range children {
+			s, jsonErr := getArchiveMemberJSON(index, index.members[child])
+			if jsonErr != nil {
+				return jsonErr
+			}
+			entries = append(entries, s)
+		}
+		s, jsonErr := json.Marshal(entries)
+		if jsonErr != nil {
+			return fmt.Errorf("Error marshalling directory: %s", jsonErr.Error())
+		}
+		cDir <- string(s)
+		return nil
+	}
+
+	close(cDir)
+	defer close(cFile)
+	return walkArchive(archivePath, func(name string, _ fs.FileInfo, r io.Reader) (bool, error) {
+		if name != member {
+			return true, nil
+		}
+		return false, sendReaderChunks(r, cFile, chunkSize)
+	})
+}
+
+func getArchiveMemberJSON(index archiveIndex, member archiveMember) ([]byte, error) {
+	info := member.info
+	if info.IsDir() {
+		s, err := json.Marshal(DirInfo{Type: "directory", Name: path.Base(member.name), Count: len(index.children[member.name])})
+		if err != nil {
+			return nil, fmt.Errorf("Error marshalling directory info: %s", err.Error())
+		}
+		return s, nil
+	}
+	mimeType := mime.TypeByExtension(path.Ext(member.name))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	s, err := json.Marshal(FileInfo{Type: "file", MimeType: mimeType, Name: path.Base(member.name), Size: int(info.Size()), Modified: int(info.ModTime().Unix()), ETag: getETag(info)})
+	if err != nil {
+		return nil, fmt.Errorf("Error marshalling file info: %s", err.Error())
+	}
+	return s, nil
+}
+
+// sendReaderChunks sends everything left in r in pieces of chunkSize. Only r
+// itself ending is a normal end; an unexpected EOF from r, like a compressed
+// member cut short, is returned as an error.
+func sendReaderChunks(r io.Reader, c chan<- []byte, chunkSize int) error {
+	for {
+		chunk := make([]byte, chunkSize)
+		n := 0
+		var err error
+		for n < chunkSize && err == nil {
+			var read int
+			read, err = r.Read(chunk[n:])
+			n += read
+		}
+		if n > 0 {
+			c <- chunk[:n]
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading file: %w", err)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestCleanMemberName(t *testing.T) {
+	tests := []struct {
+		name   string
+		want   string
+		wantOK bool
+	}{
+		{"file.txt", "file.txt", true},
+		{"dir/file.txt", "dir/file.txt", true},
+		{"dir/", "dir", true},
+		{"./dir//file.txt", "dir/file.txt", true},
+		{`dir\file.txt`, "dir/file.txt", true},
+		{"/abs/file.txt", "abs/file.txt", true},
+		{"../../etc/passwd", "etc/passwd", true},
+		{"dir/../../file.txt", "file.txt", true},
+		{"", "", false},
+		{"/", "", false},
+		{"./", "", false},
+		{"..", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := cleanMemberName(tt.name)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("got %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const auditFileName = "audit.log"
+
+// Audited actions, one for each kind of change.
+const (
+	auditWrite          = "write"
+	auditMkdir          = "mkdir"
+	auditDelete         = "delete"
+	auditTrash          = "trash"
+	auditRestore        = "restore"
+	auditPurge          = "purge"
+	auditRestoreVersion = "restore_version"
+	auditJobStart       = "job_start"
+	auditJobCancel      = "job_cancel"
+	auditShareCreate    = "share_create"
+	auditShareRevoke    = "share_revoke"
+	auditConfigReload   = "config_reload"
+	auditLogLevels      = "log_levels"
+)
+
+const (
+	auditOK    = "ok"
+	auditError = "error"
+)
+
+// AuditEntry is one change, as a line of the audit log.
+type AuditEntry struct {
+	Time        int    `json:"time"`
+	User        string `json:"user,omitempty"` // only known with auth.user_header
+	IP          string `json:"ip,omitempty"`
+	Action      string `json:"action"`
+	VirtualPath string `json:"path,omitempty"`
+	RealPath    string `json:"real_path,omitempty"`
+	Bytes       int64  `json:"bytes"`
+	Outcome     string `json:"outcome"`
+	Status      int    `json:"status,omitempty"`
+	Error       string `json:"error,omitempty"`
+	Detail      string `json:"detail,omitempty"`
+	RequestID   string `json:"request_id,omitempty"`
+}
+
+// AuditLog appends entries to audit.log in the data directory, never changing
+// what has been written. Once the file grows past the size limit it is
+// rotated to audit.log.1, pushing older logs along, and the oldest beyond the
+// configured count are removed.
+type AuditLog struct {
+	lock     sync.Mutex
+	path     string
+	file     *os.File
+	size     int64
+	maxSize  int64
+	maxFiles int
+}
+
+var auditLog = &AuditLog{}
+
+func (a *AuditLog) Open(dataPath string, config AuditConfig) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.setLimits(config)
+	a.path = filepath.Join(dataPath, auditFileName)
+
+	mkdirErr := os.MkdirAll(dataPath, 0777)
+	if mkdirErr != nil {
+		return fmt.Errorf("Error creating data directory: %s", mkdirErr.Error())
+	}
+	return a.open()
+}
+
+// Configure changes the rotation limits, from the next entry on.
+func (a *AuditLog) Configure(config AuditConfig) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.setLimits(config)
+}
+
+func (a *AuditLog) setLimits(config AuditConfig) {
+	a.maxSize = int64(config.MaxSizeMB) * 1024 * 1024
+	a.maxFiles = config.MaxFiles
+}
+
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("Error opening audit log: %s", err.Error())
+	}
+	info, statErr := file.Stat()
+	if statErr != nil {
+		file.Close()
+		return fmt.Errorf("Error opening audit log: %s", statErr.Error())
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// Append adds entry to the log. Failing to audit a change doesn't undo it, so
+// errors are only logged.
+func (a *AuditLog) Append(entry AuditEntry) {
+	s, err := json.Marshal(entry)
+	if err != nil {
+		serverLog.Error("error marshalling audit entry", "error", err)
+		return
+	}
+	s = append(s, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file == nil {
+		serverLog.Error("audit log isn't open, dropping entry", "entry", string(s))
+		return
+	}
+	if a.size > 0 && a.size+int64(len(s)) > a.maxSize {
+		rotateErr := a.rotate()
+		if rotateErr != nil {
+			serverLog.Error("error rotating audit log", "error", rotateErr)
+		}
+	}
+	n, writeErr := a.file.Write(s)
+	a.size += int64(n)
+	if writeErr != nil {
+		serverLog.Error("error writing audit log", "error", writeErr, "entry", string(s))
+	}
+}
+
+// rotatedPath is where the nth most recently rotated log is kept.
+func (a *AuditLog) rotatedPath(n int) string {
+	if n == 0 {
+		return a.path
+	}
+	return fmt.Sprintf("%s.%d", a.path, n)
+}
+
+func (a *AuditLog) rotate() error {
+	a.file.Close()
+	// with no rotated logs kept, this is the current log
+	os.Remove(a.rotatedPath(a.maxFiles))
+	for n := a.maxFiles - 1; n >= 0; n-- {
+		renameErr := os.Rename(a.rotatedPath(n), a.rotatedPath(n+1))
+		if renameErr != nil && !os.IsNotExist(renameErr) {
+			return fmt.Errorf("Error rotating %s: %s", a.rotatedPath(n), renameErr.Error())
+		}
+	}
+	return a.open()
+}
+
+func (a *AuditLog) Close() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+type AuditQuery struct {
+	User    string
+	Action  string
+	Path    string // the path or anything under it
+	Outcome string
+	After   int // unix time, 0 for no limit
+	Before  int // unix time, 0 for no limit
+	Limit   int
+}
+
+const defaultAuditLimit = 100
+const maxAuditLimit = 1000
+
+func parseAuditQuery(query url.Values) (AuditQuery, error) {
+	q := AuditQuery{User: query.Get("user"), Action: query.Get("action"), Path: strings.TrimSuffix(query.Get("path"), "/"), Outcome: query.Get("outcome"), Limit: defaultAuditLimit}
+	if q.Outcome != "" && q.Outcome != auditOK && q.Outcome != auditError {
+		return q, newError(codeBadRequest, "Unknown outcome %s", q.Outcome)
+	}
+	ints := []struct {
+		name  string
+		value *int
+	}{{"after", &q.After}, {"before", &q.Before}, {"limit", &q.Limit}}
+	for _, i := range ints {
+		s := query.Get(i.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return q, newError(codeBadRequest, "Invalid %s %s", i.name, s)
+		}
+		*i.value = n
+	}
+	q.Limit = min(max(q.Limit, 1), maxAuditLimit)
+	return q, nil
+}
+
+func (q AuditQuery) matches(entry AuditEntry) bool {
+	switch {
+	case q.User != "" && entry.User != q.User:
+		return false
+	case q.Action != "" && entry.Action != q.Action:
+		return false
+	case q.Path != "" && entry.VirtualPath != q.Path && !strings.HasPrefix(entry.VirtualPath, q.Path+"/"):
+		return false
+	case q.Outcome != "" && entry.Outcome != q.Outcome:
+		return false
+	case q.After > 0 && entry.Time < q.After:
+		return false
+	case q.Before > 0 && entry.Time >= q.Before:
+		return false
+	}
+	return true
+}
+
+// ReadAudit sends the entries matching q, newest first, reading back through
+// the rotated logs until there are enough.
+func ReadAudit(q AuditQuery, c chan<- string, cErr chan<- error) {
+	defer close(cErr)
+	defer close(c)
+
+	// the logs are only opened under the lock, so a rotation can't move them
+	// around partway through, and read once appends can carry on
+	auditLog.lock.Lock()
+	files := []*os.File{}
+	for n := 0; n <= auditLog.maxFiles; n++ {
+		file, err := os.Open(auditLog.rotatedPath(n))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			auditLog.lock.Unlock()
+			closeFiles(files)
+			cErr <- fmt.Errorf("Error reading audit log: %s", err.Error())
+			return
+		}
+		files = append(files, file)
+	}
+	auditLog.lock.Unlock()
+	defer closeFiles(files)
+
+	entries := []AuditEntry{}
+	for _, file := range files {
+		if len(entries) >= q.Limit {
+			break
+		}
+		matched, err := readAuditFile(file, q)
+		if err != nil {
+			cErr <- fmt.Errorf("Error reading audit log: %s", err.Error())
+			return
+		}
+		slices.Reverse(matched)
+		entries = append(entries, matched...)
+	}
+	entries = entries[:min(len(entries), q.Limit)]
+
+	s, err := json.Marshal(entries)
+	if err != nil {
+		cErr <- fmt.Errorf("Error marshalling audit entries: %s", err.Error())
+		return
+	}
+	c <- string(s)
+}
+
+// readAuditFile returns the entries in the log file that match q, oldest
+// first. Lines that can't be parsed, like one cut short by a crash or still
+// being written, are skipped.
+func readAuditFile(file *os.File, q AuditQuery) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		entry := AuditEntry{}
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		if q.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// auditRecord collects what a request changed while it is handled.
+type auditRecord struct {
+	lock        sync.Mutex
+	action      string
+	virtualPath string
+	realPath    string
+	detail      string
+	bytes       int64
+}
+
+type auditRecordKey struct{}
+
+func auditRecordOf(ctx context.Context) *auditRecord {
+	if ctx == nil {
+		return nil
+	}
+	record, _ := ctx.Value(auditRecordKey{}).(*auditRecord)
+	return record
+}
+
+// auditAction marks the request ctx belongs to as making a change, to be
+// audited once it has been handled.
+func auditAction(ctx context.Context, action string, virtualPath string, realPath string, detail string) {
+	record := auditRecordOf(ctx)
+	if record == nil {
+		return
+	}
+	record.lock.Lock()
+	defer record.lock.Unlock()
+	record.action = action
+	record.virtualPath = virtualPath
+	record.realPath = realPath
+	record.detail = detail
+}
+
+// auditPaths sets the paths of a change once they are known, for changes
+// that only find out what they act on part way through.
+func auditPaths(ctx context.Context, virtualPath string, realPath string) {
+	record := auditRecordOf(ctx)
+	if record == nil {
+		return
+	}
+	record.lock.Lock()
+	defer record.lock.Unlock()
+	record.virtualPath = virtualPath
+	record.realPath = realPath
+}
+
+// auditDetail adds to what else is worth knowing about a change, as it
+// comes up.
+func auditDetail(ctx context.Context, detail string) {
+	record := auditRecordOf(ctx)
+	if record == nil {
+		return
+	}
+	record.lock.Lock()
+	defer record.lock.Unlock()
+	if record.detail != "" {
+		record.detail += ", "
+	}
+	record.detail += detail
+}
+
+// auditBytes adds n to the bytes written or removed by the request ctx
+// belongs to.
+func auditBytes(ctx context.Context, n int64) {
+	record := auditRecordOf(ctx)
+	if record == nil {
+		return
+	}
+	record.lock.Lock()
+	defer record.lock.Unlock()
+	record.bytes += n
+}
+
+// auditRequests gives every request handled by h somewhere to record what it
+// changes, and appends an entry to the audit log for each that changed
+// something, with how it went.
+func auditRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record := &auditRecord{}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), auditRecordKey{}, record)))
+
+		record.lock.Lock()
+		defer record.lock.Unlock()
+		if record.action == "" {
+			return
+		}
+		entry := AuditEntry{
+			Time:        int(time.Now().Unix()),
+			User:        quotas.UserOf(r),
+			IP:          clientIP(r),
+			Action:      record.action,
+			VirtualPath: record.virtualPath,
+			RealPath:    record.realPath,
+			Bytes:       record.bytes,
+			Outcome:     auditOK,
+			Detail:      record.detail,
+			RequestID:   requestIDOf(r.Context()),
+		}
+		if recorder := responseRecorder(w); recorder != nil {
+			entry.Status = recorder.status
+			if recorder.err != nil {
+				entry.Outcome = auditError
+				entry.Error = recorder.err.Error()
+			}
+		}
+		auditLog.Append(entry)
+	})
+}
+
+// clientIP returns the address r came from. X-Forwarded-For is only believed
+// as far back as it was added to by trusted proxies, so the address is the
+// last one in it that isn't a trusted proxy's; anything before that could
+// have been made up by the client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	trusted := getSettings().TrustedProxies
+	if !isTrustedProxy(host, trusted) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for _, addr := range slices.Backward(forwarded) {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		host = addr
+		if !isTrustedProxy(addr, trusted) {
+			break
+		}
+	}
+	return host
+}
+
+func isTrustedProxy(addr string, trusted []netip.Prefix) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	return slices.ContainsFunc(trusted, func(prefix netip.Prefix) bool { return prefix.Contains(ip.Unmap()) })
+}
+
+// auditHandler serves the audit log, newest first:
+//
+//	GET /_admin/audit  with optional user, action, path (and anything under
+//	                   it), outcome (ok or error), after and before (unix
+//	                   time) and limit
+func auditHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, flusherok := w.(http.Flusher)
+		if !flusherok {
+			writeError(w, newError(codeInternal, "Streaming unsupported!"))
+			return
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		adminErr := checkAdmin(w, r, true)
+		if adminErr != nil {
+			writeError(w, adminErr)
+			return
+		}
+		if r.Method != http.MethodGet {
+			writeError(w, newError(codeMethodNotAllowed, "Method %s not allowed", r.Method))
+			return
+		}
+		q, queryErr := parseAuditQuery(r.URL.Query())
+		if queryErr != nil {
+			writeError(w, queryErr)
+			return
+		}
+		c := make(chan string)
+		cErr := make(chan error)
+		go ReadAudit(q, c, cErr)
+		writeJSONResult(w, flusher, c, cErr)
+	}
+}
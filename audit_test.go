@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	loopback := []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	private := []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("10.0.0.0/8")}
+	tests := []struct {
+		name       string
+		trusted    []netip.Prefix
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"no proxies trusted", nil, "127.0.0.1:1234", []string{"6.6.6.6"}, "127.0.0.1"},
+		{"untrusted peer", loopback, "1.2.3.4:1234", []string{"6.6.6.6"}, "1.2.3.4"},
+		{"trusted peer without header", loopback, "127.0.0.1:1234", nil, "127.0.0.1"},
+		{"trusted peer", loopback, "127.0.0.1:1234", []string{"6.6.6.6"}, "6.6.6.6"},
+		{"only as far as trusted", loopback, "127.0.0.1:1234", []string{"6.6.6.6, 10.1.2.3"}, "10.1.2.3"},
+		{"through trusted proxies", private, "127.0.0.1:1234", []string{"6.6.6.6, 10.1.2.3"}, "6.6.6.6"},
+		{"spoofed by the client", private, "127.0.0.1:1234", []string{"1.1.1.1, 6.6.6.6, 10.1.2.3"}, "6.6.6.6"},
+		{"split over headers", private, "127.0.0.1:1234", []string{"6.6.6.6", "10.1.2.3"}, "6.6.6.6"},
+		{"all trusted", private, "127.0.0.1:1234", []string{"10.0.0.1, 10.0.0.2"}, "10.0.0.1"},
+		{"empty entries", loopback, "127.0.0.1:1234", []string{"6.6.6.6, , "}, "6.6.6.6"},
+		{"peer without port", loopback, "127.0.0.1", []string{"6.6.6.6"}, "6.6.6.6"},
+		{"mapped IPv4 peer", loopback, "[::ffff:127.0.0.1]:1234", []string{"6.6.6.6"}, "6.6.6.6"},
+	}
+	old := currentSettings.Load()
+	t.Cleanup(func() { currentSettings.Store(old) })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			currentSettings.Store(&Settings{TrustedProxies: tt.trusted})
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, f := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", f)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
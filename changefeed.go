@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FeedEvent is one change as sent to clients of the change feed.
+type FeedEvent struct {
+	ID      string          `json:"id"`
+	Type    string          `json:"type"` // "create", "update", "delete" or "move"
+	Path    string          `json:"path"`
+	OldPath string          `json:"oldPath,omitempty"` // only on moves
+	Entry   json.RawMessage `json:"entry,omitempty"`   // FileInfo or DirInfo, missing on deletes
+}
+
+// FeedSubscription is the set of virtual paths a client wants to hear about.
+// Without Recursive, a path covers itself and its direct children.
+type FeedSubscription struct {
+	Paths     []string
+	Recursive bool
+}
+
+func (s FeedSubscription) matches(e FeedEvent) bool {
+	for _, p := range []string{e.Path, e.OldPath} {
+		if p == "" {
+			continue
+		}
+		for _, subscribed := range s.Paths {
+			prefix := strings.TrimSuffix(subscribed, "/") + "/"
+			if p == subscribed || (s.Recursive && strings.HasPrefix(p, prefix)) || (!s.Recursive && p[:strings.LastIndex(p, "/")+1] == prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// changeFeedBacklog is how many events are kept for clients catching up after
+// reconnecting. It is set from the config.
+var changeFeedBacklog = 10000
+
+// changeFeedBuffer is how many events a client can fall behind by before it is
+// disconnected and has to catch up from the backlog.
+const changeFeedBuffer = 256
+
+// ChangeFeed numbers every change published on the bus and hands it to the
+// clients subscribed to it. Event IDs are made of the time the server started
+// and a sequence number, and double as resume tokens: a client that passes the
+// last ID it saw gets everything after it that is still in the backlog.
+type ChangeFeed struct {
+	lock      sync.Mutex
+	basePaths map[string]string
+	epoch     string
+	seq       int
+	backlog   []FeedEvent // oldest first, the last having sequence number seq
+	clients   map[*feedClient]bool
+}
+
+type feedClient struct {
+	sub FeedSubscription
+	c   chan FeedEvent
+}
+
+var changeFeed = &ChangeFeed{epoch: strconv.FormatInt(time.Now().UnixNano(), 36), clients: map[*feedClient]bool{}}
+
+// Start feeds every change published on the bus under basePaths to clients.
+func (f *ChangeFeed) Start(basePaths map[string]string) {
+	f.SetRoots(basePaths)
+	changeBus.Subscribe(f.publish)
+}
+
+// SetRoots changes the roots whose changes are fed to clients.
+func (f *ChangeFeed) SetRoots(basePaths map[string]string) {
+	f.lock.Lock()
+	f.basePaths = basePaths
+	f.lock.Unlock()
+}
+
+func (f *ChangeFeed) publish(e ChangeEvent) {
+	f.lock.Lock()
+	basePaths := f.basePaths
+	f.lock.Unlock()
+	rootName, rootPath, ok := getRootOf(basePaths, e.Path)
+	if !ok || e.Path == rootPath {
+		return
+	}
+
+	event := FeedEvent{Type: e.Type, Path: toVirtualPath(e.Path, rootPath, "/"+rootName)}
+	switch e.Type {
+	case changeModify:
+		event.Type = "update"
+	case changeRename:
+		event.Type = "move"
+		if oldRootName, oldRootPath, oldOk := getRootOf(basePaths, e.OldPath); oldOk {
+			event.OldPath = toVirtualPath(e.OldPath, oldRootPath, "/"+oldRootName)
+		}
+	}
+	if e.Type != changeDelete {
+		if info, err := os.Stat(e.Path); err == nil {
+			entry, entryErr := getListEntryJSON(listEntry{info: info, path: e.Path}, ListOptions{Depth: 1})
+			if entryErr != nil {
+				indexLog.Error("error reading changed entry", "error", entryErr)
+			}
+			event.Entry = entry
+		}
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.seq++
+	event.ID = fmt.Sprintf("%s-%d", f.epoch, f.seq)
+	f.backlog = append(f.backlog, event)
+	if len(f.backlog) > changeFeedBacklog {
+		f.backlog = f.backlog[len(f.backlog)-changeFeedBacklog:]
+	}
+	for client := range f.clients {
+		if !client.sub.matches(event) {
+			continue
+		}
+		select {
+		case client.c <- event:
+		default:
+			// too far behind, so cut the client off rather than hold up the bus
+			close(client.c)
+			delete(f.clients, client)
+		}
+	}
+}
+
+// subscribe registers a client for sub, returning the events after since that
+// it missed, or false if it can't be caught up because since is too old or
+// from before a restart.
+func (f *ChangeFeed) subscribe(sub FeedSubscription, since string) (*feedClient, []FeedEvent, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	client := &feedClient{sub: sub, c: make(chan FeedEvent, changeFeedBuffer)}
+	f.clients[client] = true
+	if since == "" {
+		return client, nil, true
+	}
+
+	epoch, seqStr, _ := strings.Cut(since, "-")
+	seq, err := strconv.Atoi(seqStr)
+	first := f.seq - len(f.backlog) + 1
+	if err != nil || epoch != f.epoch || seq > f.seq || seq < first-1 {
+		return client, nil, false
+	}
+	missed := []FeedEvent{}
+	for _, event := range f.backlog[seq-first+1:] {
+		if sub.matches(event) {
+			missed = append(missed, event)
+		}
+	}
+	return client, missed, true
+}
+
+func (f *ChangeFeed) unsubscribe(client *feedClient) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.clients[client] {
+		close(client.c)
+		delete(f.clients, client)
+	}
+}
+
+// changeFeedHeartbeat is how often an idle feed sends a comment, so proxies
+// don't close the connection.
+const changeFeedHeartbeat = 30 * time.Second
+
+// WatchFeed sends the changes matching sub as server-sent events until done is
+// closed. If since is given, the events after it are sent first, or a reset
+// event if they are no longer known, in which case the client should list its
+// paths again. A client that falls too far behind is also sent a reset event,
+// and the feed ends.
+func WatchFeed(sub FeedSubscription, since string, done <-chan struct{}, c chan<- string) {
+	defer close(c)
+
+	client, missed, caughtUp := changeFeed.subscribe(sub, since)
+	defer changeFeed.unsubscribe(client)
+
+	send := func(s string) bool {
+		select {
+		case c <- s:
+			return true
+		case <-done:
+			return false
+		}
+	}
+	sendEvent := func(event FeedEvent) bool {
+		s, err := json.Marshal(event)
+		if err != nil {
+			indexLog.Error("error marshalling change event", "error", err)
+			return true
+		}
+		return send(fmt.Sprintf("id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, s))
+	}
+
+	if !send(": subscribed\n\n") {
+		return
+	}
+	if !caughtUp && !send("event: reset\ndata: {}\n\n") {
+		return
+	}
+	for _, event := range missed {
+		if !sendEvent(event) {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(changeFeedHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-client.c:
+			if !ok {
+				send("event: reset\ndata: {}\n\n")
+				return
+			}
+			if !sendEvent(event) {
+				return
+			}
+		case <-heartbeat.C:
+			if !send(": heartbeat\n\n") {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// parseFeedSubscription checks the paths asked for exist as roots, and cleans
+// them up so they compare with the paths of events.
+func parseFeedSubscription(paths []string, recursive bool, basePaths map[string]string) (FeedSubscription, error) {
+	sub := FeedSubscription{Recursive: recursive}
+	if len(paths) == 0 {
+		return sub, newError(codeBadRequest, "At least one path is required")
+	}
+	for _, p := range paths {
+		p = filepath.ToSlash(filepath.Clean("/" + p))
+		parts := strings.Split(p, "/")
+		if _, ok := basePaths[parts[1]]; p != "/" && !ok {
+			return sub, newError(codeNotFound, "Path %s not found!", p)
+		}
+		for _, part := range parts {
+			if isHiddenEntry(part) {
+				return sub, newError(codeNotFound, "Path %s not found!", p)
+			}
+		}
+		sub.Paths = append(sub.Paths, p)
+	}
+	return sub, nil
+}
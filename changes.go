@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of change published on the change bus.
+const (
+	changeCreate = "create"
+	changeModify = "modify"
+	changeDelete = "delete"
+	changeRename = "rename"
+)
+
+// ChangeEvent is a change to a file or directory under one of the roots. Paths
+// are real paths. A rename carries where the entry moved from in OldPath.
+type ChangeEvent struct {
+	Type    string
+	Path    string
+	OldPath string
+	Dir     bool
+}
+
+// Paths returns every path the event touched.
+func (e ChangeEvent) Paths() []string {
+	if e.OldPath != "" {
+		return []string{e.OldPath, e.Path}
+	}
+	return []string{e.Path}
+}
+
+// ChangeBus hands every change made to the roots, whether through the API or
+// found by the watcher, to everything that caches what is on disk.
+// Subscribers are called in the order they subscribed, on the publisher's
+// goroutine, so anything slow should be passed off to a goroutine of its own.
+type ChangeBus struct {
+	lock        sync.RWMutex
+	subscribers []func(ChangeEvent)
+}
+
+var changeBus = &ChangeBus{}
+
+// Subscribe calls fn with every event published from now on.
+func (b *ChangeBus) Subscribe(fn func(ChangeEvent)) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.subscribers = append(b.subscribers, fn)
+}
+
+func (b *ChangeBus) Publish(e ChangeEvent) {
+	b.lock.RLock()
+	subscribers := b.subscribers
+	b.lock.RUnlock()
+	for _, fn := range subscribers {
+		fn(e)
+	}
+}
+
+// changeQuietPeriod is how long the watcher ignores a path after a change to
+// it was published through the API, since it will see the same change on disk.
+const changeQuietPeriod = 2 * time.Second
+
+var recentChangesLock = sync.Mutex{}
+var recentChanges = map[string]time.Time{}
+
+// notifyChanged publishes a change made through the API to the file or
+// directory at path. Anything that changes the contents of a root should call
+// it with every path it touched, or notifyRemoved for paths it removed.
+func notifyChanged(changeType string, path string) {
+	info, err := os.Stat(path)
+	publishChange(changeType, path, err == nil && info.IsDir())
+}
+
+// notifyRemoved publishes the removal of path through the API. Whether it was
+// a directory is given by the caller, as it can't be found out once it's gone.
+func notifyRemoved(path string, dir bool) {
+	publishChange(changeDelete, path, dir)
+}
+
+func publishChange(changeType string, path string, dir bool) {
+	path = filepath.Clean(path)
+	now := time.Now()
+	recentChangesLock.Lock()
+	for p, changed := range recentChanges {
+		if now.Sub(changed) > changeQuietPeriod {
+			delete(recentChanges, p)
+		}
+	}
+	recentChanges[path] = now
+	recentChangesLock.Unlock()
+
+	changeBus.Publish(ChangeEvent{Type: changeType, Path: path, Dir: dir})
+}
+
+// changedRecently reports whether path, or a directory above it, was changed
+// through the API within the quiet period.
+func changedRecently(path string) bool {
+	recentChangesLock.Lock()
+	defer recentChangesLock.Unlock()
+	for p := path; ; p = filepath.Dir(p) {
+		if changed, ok := recentChanges[p]; ok && time.Since(changed) <= changeQuietPeriod {
+			return true
+		}
+		if p == filepath.Dir(p) {
+			return false
+		}
+	}
+}
+
+// subscribeCaches keeps the listing, usage, search and stream caches up to date
+// with every change published on the bus.
+func subscribeCaches() {
+	changeBus.Subscribe(func(e ChangeEvent) {
+		for _, path := range e.Paths() {
+			invalidateUsage(path)
+			forgetMimeType(path)
+		}
+	})
+	changeBus.Subscribe(func(e ChangeEvent) {
+		for _, path := range e.Paths() {
+			fileIndex.Update(path)
+			contentIndex.Queue(path)
+		}
+	})
+	changeBus.Subscribe(func(e ChangeEvent) {
+		settings := getSettings()
+		dropStaleStreams(e, settings.BasePaths, settings.StreamablePath)
+	})
+}
+
+// dropStaleStreams removes the HLS output of a video that has been rewritten,
+// or removed or moved by something other than the API, which cleans up after
+// itself. Left behind, it would be served in place of whatever appears at the
+// same path next.
+func dropStaleStreams(e ChangeEvent, basePaths map[string]string, streamablePath string) {
+	path := e.Path
+	if e.OldPath != "" {
+		path = e.OldPath
+	}
+	switch {
+	case e.Type == changeModify && !e.Dir:
+	case (e.Type == changeDelete || e.Type == changeRename) && !changedRecently(path):
+	default:
+		return
+	}
+	rootName, rootPath, ok := getRootOf(basePaths, path)
+	if !ok || path == rootPath || streamablePath == "" {
+		return
+	}
+	virtualPath := toVirtualPath(path, rootPath, "/"+rootName)
+	if e.Dir {
+		os.RemoveAll(streamablePath + virtualPath)
+		return
+	}
+	if !strings.HasPrefix(mime.TypeByExtension(filepath.Ext(path)), "video/") {
+		return
+	}
+	streamErr := deleteStreamFiles(context.Background(), virtualPath, streamablePath)
+	if streamErr != nil {
+		streamingLog.Error("error removing stale stream files", "error", streamErr)
+	}
+}
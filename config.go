@@ -0,0 +1,609 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"rnas/streaming"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configVersion is the version of the config file schema this build reads.
+// It goes up whenever a change to the schema would make old files mean
+// something different.
+const configVersion = 1
+
+// minAdminTokenLength keeps admin tokens long enough not to be guessed.
+const minAdminTokenLength = 16
+
+// defaultConfigFile is read if no config file is given and it exists.
+const defaultConfigFile = "rnas.yaml"
+
+type Config struct {
+	Version                int              `yaml:"version"`
+	Listen                 []ListenerConfig `yaml:"listen"`
+	DataPath               string           `yaml:"data_path"`
+	ChunkSize              int              `yaml:"chunk_size"`
+	MaxFileSizeMB          int              `yaml:"max_file_size_mb"` // read but not enforced
+	RescanIntervalMinutes  int              `yaml:"rescan_interval_minutes"`
+	ShutdownTimeoutSeconds int              `yaml:"shutdown_timeout_seconds"` // how long to drain on SIGTERM
+	Trash                  TrashConfig      `yaml:"trash"`
+	Versions               VersionsConfig   `yaml:"versions"`
+	Roots                  []RootConfig     `yaml:"roots"`
+	Streaming              StreamingConfig  `yaml:"streaming"`
+	Cache                  CacheConfig      `yaml:"cache"`
+	Auth                   AuthConfig       `yaml:"auth"`
+	Logging                LoggingConfig    `yaml:"logging"`
+	Audit                  AuditConfig      `yaml:"audit"`
+}
+
+type ListenerConfig struct {
+	Address string `yaml:"address"`
+	TLSCert string `yaml:"tls_cert"` // serves HTTPS if set, with TLSKey
+	TLSKey  string `yaml:"tls_key"`
+}
+
+type TrashConfig struct {
+	RetentionDays int `yaml:"retention_days"`
+}
+
+type VersionsConfig struct {
+	MaxCount   int `yaml:"max_count"`
+	MaxAgeDays int `yaml:"max_age_days"`
+}
+
+type RootConfig struct {
+	Name      string      `yaml:"name"`
+	Path      string      `yaml:"path"`
+	ReadOnly  bool        `yaml:"read_only"`
+	Hidden    bool        `yaml:"hidden"`    // left out of the top level listing
+	Streaming *bool       `yaml:"streaming"` // videos are transcoded to HLS unless false
+	Backend   string      `yaml:"backend"`   // only "local" for now
+	Quota     QuotaLimits `yaml:"quota"`
+}
+
+func (r RootConfig) StreamingEnabled() bool {
+	return r.Streaming == nil || *r.Streaming
+}
+
+// QuotaLimits is a Quota as it is written in the config. 0 means no limit.
+type QuotaLimits struct {
+	MB    int `yaml:"mb"`
+	Files int `yaml:"files"`
+}
+
+func (q QuotaLimits) Quota() Quota {
+	return Quota{Bytes: int64(q.MB) * 1024 * 1024, Files: q.Files}
+}
+
+type StreamingConfig struct {
+	Path     string             `yaml:"path"` // where HLS output is kept
+	Codec    string             `yaml:"codec"`
+	Preset   string             `yaml:"preset"`
+	CRF      int                `yaml:"crf"`
+	Profiles []TranscodeProfile `yaml:"profiles"`
+}
+
+// TranscodeProfile is one of the sizes videos are transcoded to, besides
+// their own. Profiles bigger than the video are skipped.
+type TranscodeProfile struct {
+	Name             string `yaml:"name"`
+	Width            int    `yaml:"width"`
+	Height           int    `yaml:"height"`
+	AudioBitrateKbps int    `yaml:"audio_bitrate_kbps"`
+}
+
+type CacheConfig struct {
+	MimeTypes         int `yaml:"mime_types"`
+	ArchiveIndexes    int `yaml:"archive_indexes"`
+	ChangeFeedBacklog int `yaml:"change_feed_backlog"`
+	FinishedJobs      int `yaml:"finished_jobs"`
+}
+
+// AuthConfig is how requests are tied to users and admins. UserHeader is
+// taken as it comes, so it is only safe behind a proxy that sets it and strips
+// it from what clients send.
+type AuthConfig struct {
+	UserHeader string      `yaml:"user_header"` // set by a trusted proxy, for per-user quotas
+	UserQuota  QuotaLimits `yaml:"user_quota"`
+	AdminToken string      `yaml:"admin_token"` // bearer token for /_admin, /_jobs and /_shares
+	// proxies whose X-Forwarded-For is believed, as addresses or CIDR ranges
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+type LoggingConfig struct {
+	Format string            `yaml:"format"` // text or json
+	Level  string            `yaml:"level"`
+	Levels map[string]string `yaml:"levels"` // by subsystem, overriding level
+}
+
+type AuditConfig struct {
+	MaxSizeMB int `yaml:"max_size_mb"` // rotated once it grows past this
+	MaxFiles  int `yaml:"max_files"`   // rotated logs kept, oldest dropped
+}
+
+// RootOptions are the settings of a root that requests need to know.
+type RootOptions struct {
+	ReadOnly  bool
+	Hidden    bool
+	Streaming bool
+}
+
+func defaultConfig() Config {
+	return Config{
+		Version:                configVersion,
+		Listen:                 []ListenerConfig{{Address: ":6969"}},
+		DataPath:               "data",
+		ChunkSize:              2048,
+		RescanIntervalMinutes:  60,
+		ShutdownTimeoutSeconds: 30,
+		Trash:                  TrashConfig{RetentionDays: 30},
+		Versions:               VersionsConfig{MaxCount: 10, MaxAgeDays: 90},
+		Streaming: StreamingConfig{Codec: "libx265", Preset: "medium", CRF: 23, Profiles: []TranscodeProfile{
+			{Name: "1080p", Width: 1920, Height: 1080, AudioBitrateKbps: 256},
+			{Name: "720p", Width: 1280, Height: 720, AudioBitrateKbps: 192},
+			{Name: "360p", Width: 640, Height: 360, AudioBitrateKbps: 128},
+		}},
+		Cache:   CacheConfig{MimeTypes: 100000, ArchiveIndexes: 64, ChangeFeedBacklog: 10000, FinishedJobs: 100},
+		Logging: LoggingConfig{Format: "text", Level: "info"},
+		Audit:   AuditConfig{MaxSizeMB: 10, MaxFiles: 5},
+	}
+}
+
+// LoadConfig builds the config from, in increasing order of precedence, the
+// defaults, the config file, env vars and the flags in args. Every problem
+// found is returned at once, joined into one error.
+func LoadConfig(args []string) (Config, error) {
+	config := defaultConfig()
+
+	flags := flag.NewFlagSet("rnas", flag.ContinueOnError)
+	configPath := flags.String("config", "", "config file to read, "+defaultConfigFile+" by default")
+	listen := flags.String("listen", "", "address to listen on, instead of the configured listeners")
+	dataPath := flags.String("data", "", "directory to keep indexes, shares and other state in")
+	streamablePath := flags.String("streamable", "", "directory to keep transcoded videos in")
+	chunkSize := flags.Int("chunk-size", 0, "size of the chunks files are sent in")
+	roots := rootFlags{}
+	flags.Var(&roots, "root", "root to serve as name=path, may be repeated")
+	parseErr := flags.Parse(args)
+	if parseErr != nil {
+		return config, parseErr
+	}
+	if flags.NArg() > 0 {
+		return config, fmt.Errorf("Unexpected argument %s", flags.Arg(0))
+	}
+
+	file := *configPath
+	if file == "" {
+		file = os.Getenv("RNAS_CONFIG")
+	}
+	if file == "" {
+		if _, err := os.Stat(defaultConfigFile); err == nil {
+			file = defaultConfigFile
+		}
+	}
+	errs := []error{}
+	var fromFile any
+	if file != "" {
+		readErr := readConfigFile(file, &config)
+		if readErr != nil {
+			errs = append(errs, readErr)
+		}
+		fromFile = toYAMLValue(config)
+	}
+
+	errs = append(errs, applyConfigEnv(&config)...)
+	if fromFile != nil {
+		if overridden := overriddenSettings(toYAMLValue(defaultConfig()), fromFile, config); len(overridden) > 0 {
+			configLog.Warn("env vars override settings from the config file", "file", file, "settings", overridden)
+		}
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			config.Listen = []ListenerConfig{{Address: *listen}}
+		case "data":
+			config.DataPath = *dataPath
+		case "streamable":
+			config.Streaming.Path = *streamablePath
+		case "chunk-size":
+			config.ChunkSize = *chunkSize
+		}
+	})
+	for _, root := range roots {
+		setConfigRoot(&config, root[0], root[1])
+	}
+
+	return config, errors.Join(append(errs, config.Validate()...)...)
+}
+
+func readConfigFile(file string, config *Config) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("Error reading config file: %s", err.Error())
+	}
+	defer f.Close()
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	// a file that doesn't say which version it is can't pass for this one
+	config.Version = 0
+	errs := []error{}
+	decodeErr := decoder.Decode(config)
+	typeErr := &yaml.TypeError{}
+	switch {
+	case errors.As(decodeErr, &typeErr):
+		// the rest of the file is still decoded, so its problems are found too
+		for _, e := range typeErr.Errors {
+			errs = append(errs, fmt.Errorf("%s: %s", file, e))
+		}
+	case decodeErr != nil:
+		return fmt.Errorf("Error parsing config file %s: %s", file, decodeErr.Error())
+	}
+	if config.Version != configVersion {
+		errs = append(errs, fmt.Errorf("%s: version must be %d, not %d", file, configVersion, config.Version))
+	}
+	return errors.Join(errs...)
+}
+
+// overriddenSettings lists the settings the config file changed from the
+// defaults that env vars have changed again, as the file no longer says what
+// rnas is running with for those.
+func overriddenSettings(defaults any, fromFile any, config Config) []string {
+	defaultValues, fileValues, values := map[string]string{}, map[string]string{}, map[string]string{}
+	flattenConfigValue("", defaults, defaultValues)
+	flattenConfigValue("", fromFile, fileValues)
+	flattenConfigValue("", toYAMLValue(config), values)
+	overridden := []string{}
+	for _, key := range slices.Sorted(maps.Keys(fileValues)) {
+		if fileValues[key] != defaultValues[key] && values[key] != fileValues[key] {
+			overridden = append(overridden, key)
+		}
+	}
+	return overridden
+}
+
+// applyConfigEnv overrides the config with the env vars rnas was configured
+// with before it had a config file.
+func applyConfigEnv(config *Config) []error {
+	errs := []error{}
+	if port, hasPort := os.LookupEnv("PORT"); hasPort {
+		config.Listen = []ListenerConfig{{Address: ":" + port}}
+	}
+	if dataPath, hasDataPath := os.LookupEnv("DATA_PATH"); hasDataPath {
+		config.DataPath = dataPath
+	}
+	if streamablePath, hasStreamablePath := os.LookupEnv("STREAMABLE_PATH"); hasStreamablePath {
+		config.Streaming.Path = streamablePath
+	}
+	if userHeader, hasUserHeader := os.LookupEnv("USER_HEADER"); hasUserHeader {
+		config.Auth.UserHeader = userHeader
+	}
+	if adminToken, hasAdminToken := os.LookupEnv("ADMIN_TOKEN"); hasAdminToken {
+		config.Auth.AdminToken = adminToken
+	}
+	if trustedProxies, hasTrustedProxies := os.LookupEnv("TRUSTED_PROXIES"); hasTrustedProxies {
+		config.Auth.TrustedProxies = strings.FieldsFunc(trustedProxies, func(r rune) bool { return r == ',' || r == ' ' })
+	}
+	if logFormat, hasLogFormat := os.LookupEnv("LOG_FORMAT"); hasLogFormat {
+		config.Logging.Format = logFormat
+	}
+	if logLevel, hasLogLevel := os.LookupEnv("LOG_LEVEL"); hasLogLevel {
+		config.Logging.Level = logLevel
+	}
+	ints := []struct {
+		name   string
+		target *int
+	}{
+		{"CHUNK_SIZE", &config.ChunkSize},
+		{"MAX_FILE_SIZE_MB", &config.MaxFileSizeMB},
+		{"RESCAN_INTERVAL_MINUTES", &config.RescanIntervalMinutes},
+		{"SHUTDOWN_TIMEOUT_SECONDS", &config.ShutdownTimeoutSeconds},
+		{"TRASH_RETENTION_DAYS", &config.Trash.RetentionDays},
+		{"VERSION_MAX_COUNT", &config.Versions.MaxCount},
+		{"VERSION_MAX_AGE_DAYS", &config.Versions.MaxAgeDays},
+		{"USER_QUOTA_MB", &config.Auth.UserQuota.MB},
+		{"USER_QUOTA_FILES", &config.Auth.UserQuota.Files},
+		{"AUDIT_MAX_SIZE_MB", &config.Audit.MaxSizeMB},
+		{"AUDIT_MAX_FILES", &config.Audit.MaxFiles},
+	}
+	for _, i := range ints {
+		if err := overrideConfigInt(i.name, i.target); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for n := 1; ; n++ {
+		varname := fmt.Sprint("PATH_", n)
+		path, pathexists := os.LookupEnv(varname)
+		if !pathexists {
+			break
+		}
+		pathname, pathnameexists := os.LookupEnv(varname + "_NAME")
+		if !pathnameexists {
+			errs = append(errs, fmt.Errorf("%s exists but %s_NAME does not", varname, varname))
+			continue
+		}
+		root := setConfigRoot(config, pathname, path)
+		if err := overrideConfigInt(varname+"_QUOTA_MB", &root.Quota.MB); err != nil {
+			errs = append(errs, err)
+		}
+		if err := overrideConfigInt(varname+"_QUOTA_FILES", &root.Quota.Files); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func overrideConfigInt(name string, target *int) error {
+	s, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("Error converting %s env var to int: %s", name, err.Error())
+	}
+	*target = n
+	return nil
+}
+
+// setConfigRoot points the root called name at path, adding it if there isn't
+// one, and returns it.
+func setConfigRoot(config *Config, name string, path string) *RootConfig {
+	for i := range config.Roots {
+		if config.Roots[i].Name == name {
+			config.Roots[i].Path = path
+			return &config.Roots[i]
+		}
+	}
+	config.Roots = append(config.Roots, RootConfig{Name: name, Path: path})
+	return &config.Roots[len(config.Roots)-1]
+}
+
+// rootFlags collects repeated -root name=path flags.
+type rootFlags [][2]string
+
+func (r *rootFlags) String() string {
+	return fmt.Sprint(*r)
+}
+
+func (r *rootFlags) Set(value string) error {
+	name, path, ok := strings.Cut(value, "=")
+	if !ok || name == "" || path == "" {
+		return fmt.Errorf("root must be given as name=path")
+	}
+	*r = append(*r, [2]string{name, path})
+	return nil
+}
+
+// Validate returns everything wrong with the config.
+func (c Config) Validate() []error {
+	errs := []error{}
+	fail := func(field string, format string, a ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, a...)))
+	}
+
+	if len(c.Listen) == 0 {
+		fail("listen", "at least one listener is required")
+	}
+	for i, l := range c.Listen {
+		field := fmt.Sprintf("listen[%d]", i)
+		_, port, err := net.SplitHostPort(l.Address)
+		if err != nil {
+			fail(field+".address", "%s is not a valid address", l.Address)
+		} else if n, portErr := strconv.Atoi(port); portErr != nil || n < 0 || n > 65535 {
+			fail(field+".address", "%s is not a valid port", port)
+		}
+		if (l.TLSCert == "") != (l.TLSKey == "") {
+			fail(field, "tls_cert and tls_key must be given together")
+		}
+		for _, file := range []string{l.TLSCert, l.TLSKey} {
+			if _, err := os.Stat(file); file != "" && err != nil {
+				fail(field, "cannot read %s", file)
+			}
+		}
+	}
+	if c.DataPath == "" {
+		fail("data_path", "is required")
+	}
+	if c.ChunkSize <= 0 {
+		fail("chunk_size", "must be positive")
+	}
+	nonNegative := []struct {
+		field string
+		n     int
+	}{
+		{"max_file_size_mb", c.MaxFileSizeMB},
+		{"rescan_interval_minutes", c.RescanIntervalMinutes},
+		{"shutdown_timeout_seconds", c.ShutdownTimeoutSeconds},
+		{"trash.retention_days", c.Trash.RetentionDays},
+		{"versions.max_count", c.Versions.MaxCount},
+		{"versions.max_age_days", c.Versions.MaxAgeDays},
+		{"auth.user_quota.mb", c.Auth.UserQuota.MB},
+		{"auth.user_quota.files", c.Auth.UserQuota.Files},
+		{"audit.max_files", c.Audit.MaxFiles},
+	}
+	for _, v := range nonNegative {
+		if v.n < 0 {
+			fail(v.field, "cannot be negative")
+		}
+	}
+
+	if len(c.Roots) == 0 {
+		fail("roots", "at least one root is required")
+	}
+	names := map[string]bool{}
+	streaming := false
+	for i, root := range c.Roots {
+		field := fmt.Sprintf("roots[%d]", i)
+		switch {
+		case root.Name == "":
+			fail(field+".name", "is required")
+		case strings.ContainsAny(root.Name, `/\`) || strings.HasPrefix(root.Name, ".") || strings.HasPrefix(root.Name, "_"):
+			// paths starting with _ are the server's own endpoints
+			fail(field+".name", "%s cannot contain slashes or start with . or _", root.Name)
+		case root.Name == "metrics":
+			fail(field+".name", "metrics is taken by the metrics endpoint")
+		case names[root.Name]:
+			fail(field+".name", "%s is used by another root", root.Name)
+		}
+		names[root.Name] = true
+		if info, err := os.Stat(root.Path); root.Path == "" {
+			fail(field+".path", "is required")
+		} else if err != nil || !info.IsDir() {
+			fail(field+".path", "%s is not a directory", root.Path)
+		}
+		if root.Backend != "" && root.Backend != "local" {
+			fail(field+".backend", "unknown backend %s", root.Backend)
+		}
+		if root.Quota.MB < 0 || root.Quota.Files < 0 {
+			fail(field+".quota", "cannot be negative")
+		}
+		streaming = streaming || root.StreamingEnabled()
+	}
+
+	if streaming && c.Streaming.Path == "" {
+		fail("streaming.path", "is required while any root has streaming enabled")
+	}
+	if c.Streaming.Codec == "" || c.Streaming.Preset == "" {
+		fail("streaming", "codec and preset are required")
+	}
+	if strings.ContainsAny(c.Streaming.Codec+c.Streaming.Preset, " \t") {
+		fail("streaming", "codec and preset cannot contain spaces")
+	}
+	if c.Streaming.CRF < 0 || c.Streaming.CRF > 51 {
+		fail("streaming.crf", "must be between 0 and 51")
+	}
+	// with the source's own size, that is the ten variants HLS output can be
+	// told apart by
+	if len(c.Streaming.Profiles) > 9 {
+		fail("streaming.profiles", "at most 9 profiles can be given")
+	}
+	profiles := map[string]bool{}
+	for i, profile := range c.Streaming.Profiles {
+		field := fmt.Sprintf("streaming.profiles[%d]", i)
+		if profile.Name == "" || profiles[profile.Name] {
+			fail(field+".name", "must be given and unique")
+		}
+		profiles[profile.Name] = true
+		if profile.Width <= 0 || profile.Height <= 0 || profile.AudioBitrateKbps <= 0 {
+			fail(field, "width, height and audio_bitrate_kbps must be positive")
+		}
+	}
+
+	positive := []struct {
+		field string
+		n     int
+	}{
+		{"cache.mime_types", c.Cache.MimeTypes},
+		{"cache.archive_indexes", c.Cache.ArchiveIndexes},
+		{"cache.change_feed_backlog", c.Cache.ChangeFeedBacklog},
+		{"cache.finished_jobs", c.Cache.FinishedJobs},
+		{"audit.max_size_mb", c.Audit.MaxSizeMB},
+	}
+	for _, v := range positive {
+		if v.n <= 0 {
+			fail(v.field, "must be positive")
+		}
+	}
+	if strings.ContainsAny(c.Auth.UserHeader, " :") {
+		fail("auth.user_header", "%s is not a valid header name", c.Auth.UserHeader)
+	}
+	if c.Auth.AdminToken != "" && len(c.Auth.AdminToken) < minAdminTokenLength {
+		fail("auth.admin_token", "must be at least %d characters", minAdminTokenLength)
+	}
+	for i, proxy := range c.Auth.TrustedProxies {
+		if _, err := parseTrustedProxy(proxy); err != nil {
+			fail(fmt.Sprintf("auth.trusted_proxies[%d]", i), "%s is not an address or CIDR range", proxy)
+		}
+	}
+
+	if c.Logging.Format != "text" && c.Logging.Format != "json" {
+		fail("logging.format", "must be text or json")
+	}
+	level := slog.LevelInfo
+	if err := level.UnmarshalText([]byte(c.Logging.Level)); err != nil {
+		fail("logging.level", "%s is not a level, like debug, info, warn or error", c.Logging.Level)
+	}
+	for _, subsystem := range slices.Sorted(maps.Keys(c.Logging.Levels)) {
+		field := "logging.levels." + subsystem
+		if !slices.Contains(logSubsystems, subsystem) {
+			fail(field, "unknown subsystem, expected one of %s", strings.Join(logSubsystems, ", "))
+		} else if err := level.UnmarshalText([]byte(c.Logging.Levels[subsystem])); err != nil {
+			fail(field, "%s is not a level, like debug, info, warn or error", c.Logging.Levels[subsystem])
+		}
+	}
+	return errs
+}
+
+func (c Config) BasePaths() map[string]string {
+	basePaths := map[string]string{}
+	for _, root := range c.Roots {
+		basePaths[root.Name] = filepath.Clean(root.Path)
+	}
+	return basePaths
+}
+
+func (c Config) RootOptions() map[string]RootOptions {
+	options := map[string]RootOptions{}
+	for _, root := range c.Roots {
+		options[root.Name] = RootOptions{ReadOnly: root.ReadOnly, Hidden: root.Hidden, Streaming: root.StreamingEnabled()}
+	}
+	return options
+}
+
+// TrustedProxies returns the ranges of addresses that are trusted to say who
+// they forwarded a request for. Invalid ones are caught by validation.
+func (c Config) TrustedProxies() []netip.Prefix {
+	prefixes := []netip.Prefix{}
+	for _, proxy := range c.Auth.TrustedProxies {
+		if prefix, err := parseTrustedProxy(proxy); err == nil {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+func parseTrustedProxy(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+func (c Config) QuotaConfig() QuotaConfig {
+	quotaConfig := QuotaConfig{Roots: map[string]Quota{}, User: c.Auth.UserQuota.Quota(), UserHeader: c.Auth.UserHeader}
+	for _, root := range c.Roots {
+		quotaConfig.Roots[root.Name] = root.Quota.Quota()
+	}
+	return quotaConfig
+}
+
+func (c Config) VersionRetention() VersionRetention {
+	return VersionRetention{MaxCount: c.Versions.MaxCount, MaxAge: time.Duration(c.Versions.MaxAgeDays) * 24 * time.Hour}
+}
+
+// StreamingOutputs are the transcoding profiles as the streaming package takes them.
+func (c Config) StreamingOutputs() ([]streaming.FFMpegOutput, streaming.Encoder) {
+	outputs := []streaming.FFMpegOutput{}
+	for _, profile := range c.Streaming.Profiles {
+		outputs = append(outputs, streaming.FFMpegOutput{Width: profile.Width, Height: profile.Height, AudioBitrate: profile.AudioBitrateKbps})
+	}
+	return outputs, streaming.Encoder{Codec: c.Streaming.Codec, Preset: c.Streaming.Preset, CRF: c.Streaming.CRF}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testConfig(t *testing.T) Config {
+	config := defaultConfig()
+	config.Roots = []RootConfig{{Name: "files", Path: t.TempDir()}}
+	config.Streaming.Path = t.TempDir()
+	return config
+}
+
+func TestValidate(t *testing.T) {
+	noStreaming := false
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   []string // the fields complained about
+	}{
+		{"valid", func(c *Config) {}, []string{}},
+		{"no listeners", func(c *Config) { c.Listen = nil }, []string{"listen"}},
+		{"bad address", func(c *Config) { c.Listen[0].Address = "6969" }, []string{"listen[0].address"}},
+		{"bad port", func(c *Config) { c.Listen[0].Address = ":70000" }, []string{"listen[0].address"}},
+		{"cert without key", func(c *Config) { c.Listen[0].TLSCert = c.Roots[0].Path }, []string{"listen[0]"}},
+		{"no data path", func(c *Config) { c.DataPath = "" }, []string{"data_path"}},
+		{"no chunk size", func(c *Config) { c.ChunkSize = 0 }, []string{"chunk_size"}},
+		{"negative values", func(c *Config) { c.MaxFileSizeMB, c.Trash.RetentionDays = -1, -1 }, []string{"max_file_size_mb", "trash.retention_days"}},
+		{"no roots", func(c *Config) { c.Roots = nil }, []string{"roots"}},
+		{"unnamed root", func(c *Config) { c.Roots[0].Name = "" }, []string{"roots[0].name"}},
+		{"reserved root name", func(c *Config) { c.Roots[0].Name = "_trash" }, []string{"roots[0].name"}},
+		{"root name with a slash", func(c *Config) { c.Roots[0].Name = "a/b" }, []string{"roots[0].name"}},
+		{"metrics root", func(c *Config) { c.Roots[0].Name = "metrics" }, []string{"roots[0].name"}},
+		{"duplicate root", func(c *Config) { c.Roots = append(c.Roots, c.Roots[0]) }, []string{"roots[1].name"}},
+		{"missing root path", func(c *Config) { c.Roots[0].Path = c.Roots[0].Path + "/missing" }, []string{"roots[0].path"}},
+		{"unknown backend", func(c *Config) { c.Roots[0].Backend = "s3" }, []string{"roots[0].backend"}},
+		{"negative quota", func(c *Config) { c.Roots[0].Quota.MB = -1 }, []string{"roots[0].quota"}},
+		{"streaming without a path", func(c *Config) { c.Streaming.Path = "" }, []string{"streaming.path"}},
+		{"no streaming without a path", func(c *Config) { c.Streaming.Path, c.Roots[0].Streaming = "", &noStreaming }, []string{}},
+		{"spaces in codec", func(c *Config) { c.Streaming.Codec = "libx265 -y" }, []string{"streaming"}},
+		{"crf out of range", func(c *Config) { c.Streaming.CRF = 52 }, []string{"streaming.crf"}},
+		{"too many profiles", func(c *Config) {
+			for range 7 {
+				c.Streaming.Profiles = append(c.Streaming.Profiles, TranscodeProfile{Name: "p" + strings.Repeat("x", len(c.Streaming.Profiles)), Width: 1, Height: 1, AudioBitrateKbps: 1})
+			}
+		}, []string{"streaming.profiles"}},
+		{"duplicate profile", func(c *Config) { c.Streaming.Profiles[1].Name = c.Streaming.Profiles[0].Name }, []string{"streaming.profiles[1].name"}},
+		{"no cache", func(c *Config) { c.Cache.MimeTypes = 0 }, []string{"cache.mime_types"}},
+		{"bad user header", func(c *Config) { c.Auth.UserHeader = "X-User: me" }, []string{"auth.user_header"}},
+		{"short admin token", func(c *Config) { c.Auth.AdminToken = "secret" }, []string{"auth.admin_token"}},
+		{"trusted proxies", func(c *Config) { c.Auth.TrustedProxies = []string{"10.0.0.1", "10.0.0.0/8", "::1"} }, []string{}},
+		{"bad trusted proxy", func(c *Config) { c.Auth.TrustedProxies = []string{"10.0.0.1", "proxy"} }, []string{"auth.trusted_proxies[1]"}},
+		{"bad log format", func(c *Config) { c.Logging.Format = "xml" }, []string{"logging.format"}},
+		{"bad log level", func(c *Config) { c.Logging.Level = "loud" }, []string{"logging.level"}},
+		{"unknown log subsystem", func(c *Config) { c.Logging.Levels = map[string]string{"nothing": "debug"} }, []string{"logging.levels.nothing"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig(t)
+			tt.change(&config)
+			fields := []string{}
+			for _, err := range config.Validate() {
+				field, _, _ := strings.Cut(err.Error(), ": ")
+				fields = append(fields, field)
+			}
+			if !slices.Equal(fields, tt.want) {
+				t.Errorf("got errors for %v, want %v", fields, tt.want)
+			}
+		})
+	}
+}
+
+func TestOverriddenSettings(t *testing.T) {
+	defaults := defaultConfig()
+	fromFile := defaultConfig()
+	fromFile.DataPath = "/var/lib/rnas"
+	fromFile.ChunkSize = 4096
+	fromFile.Roots = []RootConfig{{Name: "files", Path: "/srv/files"}}
+
+	config := fromFile
+	config.DataPath = "/tmp/rnas"
+	config.Trash.RetentionDays = 1
+	config.Roots = []RootConfig{{Name: "files", Path: "/srv/other"}, {Name: "more", Path: "/srv/more"}}
+
+	got := overriddenSettings(toYAMLValue(defaults), toYAMLValue(fromFile), config)
+	want := []string{"data_path", "roots[0].path"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
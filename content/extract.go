@@ -0,0 +1,97 @@
+package content
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Log is where the content package logs. rnas points it at its own logger.
+var Log = slog.Default()
+
+var textMimeTypes = []string{"application/json", "application/xml", "application/javascript", "application/x-sh", "application/x-yaml", "application/toml", "image/svg+xml"}
+
+// IsExtractable reports whether text can be pulled out of files of this mime type.
+func IsExtractable(mime string) bool {
+	mime, _, _ = strings.Cut(mime, ";")
+	return strings.HasPrefix(mime, "text/") || mime == "application/pdf" || slices.Contains(textMimeTypes, mime)
+}
+
+// ExtractText returns up to maxBytes of the text in the file at path. PDFs are
+// converted with pdftotext, everything else is read as it is.
+func ExtractText(path string, mime string, maxBytes int) (string, error) {
+	mime, _, _ = strings.Cut(mime, ";")
+	if mime == "application/pdf" {
+		return extractPdf(path, maxBytes)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	text, err := io.ReadAll(io.LimitReader(file, int64(maxBytes)))
+	if err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(mime, "html") || strings.HasSuffix(mime, "xml") {
+		text = stripTags(text)
+	}
+	return strings.ToValidUTF8(string(text), ""), nil
+}
+
+func extractPdf(path string, maxBytes int) (string, error) {
+	extract := exec.Command("pdftotext", "-q", "-enc", "UTF-8", path, "-")
+	Log.Debug("extracting pdf text", "command", extract.String())
+	out, err := extract.Output()
+	if err != nil {
+		return "", fmt.Errorf("Error running pdftotext: %s", err.Error())
+	}
+	if len(out) > maxBytes {
+		out = out[:maxBytes]
+	}
+	return strings.ToValidUTF8(string(out), ""), nil
+}
+
+// stripTags blanks out markup so only the text between tags is indexed.
+func stripTags(text []byte) []byte {
+	out := bytes.Buffer{}
+	inTag := false
+	for _, b := range text {
+		switch {
+		case b == '<':
+			inTag = true
+			out.WriteByte(' ')
+		case b == '>':
+			inTag = false
+		case !inTag:
+			out.WriteByte(b)
+		}
+	}
+	return out.Bytes()
+}
+
+const minTermLength = 2
+const maxTermLength = 64
+
+// Tokenize splits text into lower case terms of letters and digits.
+func Tokenize(text string) []string {
+	terms := []string{}
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		length := utf8.RuneCountInString(field)
+		if length < minTermLength || length > maxTermLength {
+			continue
+		}
+		terms = append(terms, strings.ToLower(field))
+	}
+	return terms
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io/fs"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"rnas/content"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxContentFileSize is the largest file whose contents get indexed, and
+// maxContentTextSize is how much of its text is kept.
+const maxContentFileSize = 64 * 1024 * 1024
+const maxContentTextSize = 1024 * 1024
+
+const contentIndexDirName = "content"
+const contentIndexFileName = "index.gob"
+
+type contentDoc struct {
+	Root     string
+	Path     string // virtual path
+	Size     int
+	Modified int
+	Terms    map[string]int
+	TextFile string // name of the file in the content store holding the extracted text
+}
+
+// ContentIndex is an inverted index over the text of every document in every
+// root. The extracted text is kept in the content store alongside it so search
+// results can be given snippets without extracting the text again.
+type ContentIndex struct {
+	lock     sync.RWMutex
+	docs     map[string]contentDoc     // keyed by real path
+	postings map[string]map[string]int // term -> real path -> occurrences
+	dir      string
+	dirty    bool
+	queue    chan string
+}
+
+var contentIndex = &ContentIndex{docs: map[string]contentDoc{}, postings: map[string]map[string]int{}, queue: make(chan string, 1024)}
+
+// Load reads the content index saved in dataPath, if there is one.
+func (idx *ContentIndex) Load(dataPath string) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	idx.dir = filepath.Join(dataPath, contentIndexDirName)
+
+	f, err := os.Open(filepath.Join(idx.dir, contentIndexFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading content index: %s", err.Error())
+	}
+	defer f.Close()
+	docs := map[string]contentDoc{}
+	decodeErr := gob.NewDecoder(f).Decode(&docs)
+	if decodeErr != nil {
+		return fmt.Errorf("Error reading content index: %s", decodeErr.Error())
+	}
+	idx.docs = docs
+	idx.postings = map[string]map[string]int{}
+	for path, doc := range docs {
+		idx.addPostings(path, doc)
+	}
+	return nil
+}
+
+// Rebuild brings the content index in line with the file index, extracting
+// the text of any document that is new or has changed since it was indexed.
+func (idx *ContentIndex) Rebuild() {
+	start := time.Now()
+	files := fileIndex.Files()
+
+	idx.lock.RLock()
+	stale := []string{}
+	for path := range idx.docs {
+		if _, ok := files[path]; !ok {
+			stale = append(stale, path)
+		}
+	}
+	idx.lock.RUnlock()
+	for _, path := range stale {
+		idx.remove(path)
+	}
+
+	indexed := 0
+	for path, entry := range files {
+		if !content.IsExtractable(entry.MimeType) {
+			continue
+		}
+		idx.lock.RLock()
+		doc, ok := idx.docs[path]
+		idx.lock.RUnlock()
+		if ok && doc.Size == entry.Size && doc.Modified == entry.Modified {
+			continue
+		}
+		if idx.index(path) {
+			indexed++
+		}
+	}
+	indexLog.Info("indexed contents", "files", indexed, "duration", time.Since(start))
+	idx.Save()
+}
+
+// Queue re-indexes the contents of the file or directory at path in the
+// background, dropping it from the index if it no longer exists.
+func (idx *ContentIndex) Queue(path string) {
+	select {
+	case idx.queue <- path:
+	default:
+		indexLog.Warn("content index queue full, dropping", "path", path)
+	}
+}
+
+// Work runs forever, re-indexing the paths given to Queue.
+func (idx *ContentIndex) Work() {
+	for path := range idx.queue {
+		path = filepath.Clean(path)
+		prefix := path + string(filepath.Separator)
+		idx.lock.RLock()
+		removed := []string{}
+		for indexed := range idx.docs {
+			if indexed == path || strings.HasPrefix(indexed, prefix) {
+				removed = append(removed, indexed)
+			}
+		}
+		idx.lock.RUnlock()
+		for _, indexed := range removed {
+			idx.remove(indexed)
+		}
+
+		filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if isHiddenEntry(d.Name()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.IsDir() {
+				idx.index(p)
+			}
+			return nil
+		})
+	}
+}
+
+// index extracts and indexes the text of the file at path, returning false if
+// it isn't a document or couldn't be read.
+func (idx *ContentIndex) index(path string) bool {
+	rootName, rootPath, ok := getRootOf(fileIndex.Roots(), path)
+	if !ok {
+		return false
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > maxContentFileSize {
+		return false
+	}
+	mime := getMimeType(path, info)
+	if !content.IsExtractable(mime) {
+		return false
+	}
+	text, err := content.ExtractText(path, mime, maxContentTextSize)
+	if err != nil {
+		indexLog.Warn("error extracting text", "path", path, "error", err)
+		return false
+	}
+
+	doc := contentDoc{Root: rootName, Path: toVirtualPath(path, rootPath, "/"+rootName), Size: int(info.Size()), Modified: int(info.ModTime().Unix()), Terms: map[string]int{}, TextFile: getContentTextFile(path)}
+	for _, term := range content.Tokenize(text) {
+		doc.Terms[term]++
+	}
+	mkdirErr := os.MkdirAll(idx.dir, 0777)
+	if mkdirErr != nil {
+		indexLog.Error("error saving extracted text", "error", mkdirErr)
+		return false
+	}
+	writeErr := os.WriteFile(filepath.Join(idx.dir, doc.TextFile), []byte(text), 0666)
+	if writeErr != nil {
+		indexLog.Error("error saving extracted text", "error", writeErr)
+		return false
+	}
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if old, ok := idx.docs[path]; ok {
+		idx.removePostings(path, old)
+	}
+	idx.docs[path] = doc
+	idx.addPostings(path, doc)
+	idx.dirty = true
+	return true
+}
+
+func (idx *ContentIndex) remove(path string) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	doc, ok := idx.docs[path]
+	if !ok {
+		return
+	}
+	idx.removePostings(path, doc)
+	delete(idx.docs, path)
+	os.Remove(filepath.Join(idx.dir, doc.TextFile))
+	idx.dirty = true
+}
+
+func (idx *ContentIndex) addPostings(path string, doc contentDoc) {
+	for term, count := range doc.Terms {
+		if idx.postings[term] == nil {
+			idx.postings[term] = map[string]int{}
+		}
+		idx.postings[term][path] = count
+	}
+}
+
+func (idx *ContentIndex) removePostings(path string, doc contentDoc) {
+	for term := range doc.Terms {
+		delete(idx.postings[term], path)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+}
+
+// Save writes the content index to disk if it has changed since it was last saved.
+func (idx *ContentIndex) Save() {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if !idx.dirty || idx.dir == "" {
+		return
+	}
+	mkdirErr := os.MkdirAll(idx.dir, 0777)
+	if mkdirErr != nil {
+		indexLog.Error("error saving content index", "error", mkdirErr)
+		return
+	}
+	file := filepath.Join(idx.dir, contentIndexFileName)
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		indexLog.Error("error saving content index", "error", err)
+		return
+	}
+	encodeErr := gob.NewEncoder(f).Encode(idx.docs)
+	closeErr := f.Close()
+	if encodeErr != nil || closeErr != nil {
+		indexLog.Error("error saving content index", "error", errors.Join(encodeErr, closeErr))
+		os.Remove(tmp)
+		return
+	}
+	renameErr := os.Rename(tmp, file)
+	if renameErr != nil {
+		indexLog.Error("error saving content index", "error", renameErr)
+		return
+	}
+	idx.dirty = false
+}
+
+func getContentTextFile(path string) string {
+	sum := sha1.Sum([]byte(path))
+	return hex.EncodeToString(sum[:]) + ".txt"
+}
+
+type ContentQuery struct {
+	Terms []string
+	Roots []string
+	Limit int
+}
+
+type ContentResult struct {
+	Root    string  `json:"root"`
+	Path    string  `json:"path"`
+	Score   float64 `json:"score"`
+	Snippet string  `json:"snippet"` // HTML escaped, with matches wrapped in <mark>
+}
+
+func parseContentQuery(query url.Values) (ContentQuery, error) {
+	q := ContentQuery{Roots: query["root"], Limit: defaultSearchLimit}
+	for _, term := range content.Tokenize(query.Get("q")) {
+		if !slices.Contains(q.Terms, term) {
+			q.Terms = append(q.Terms, term)
+		}
+	}
+	if len(q.Terms) == 0 {
+		return q, newError(codeBadRequest, "A search needs at least one word to look for")
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return q, newError(codeBadRequest, "Invalid limit %s", limit)
+		}
+		q.Limit = min(n, maxSearchLimit)
+	}
+	return q, nil
+}
+
+// Search returns the documents containing every term in q, ranked by tf-idf.
+func (idx *ContentIndex) Search(q ContentQuery) []ContentResult {
+	idx.lock.RLock()
+	scores := map[string]float64{}
+	for i, term := range q.Terms {
+		postings := idx.postings[term]
+		idf := math.Log(1 + float64(len(idx.docs))/float64(max(len(postings), 1)))
+		next := map[string]float64{}
+		for path, count := range postings {
+			score, ok := scores[path]
+			if i > 0 && !ok {
+				continue
+			}
+			next[path] = score + float64(count)*idf
+		}
+		scores = next
+	}
+	type match struct {
+		result   ContentResult
+		textFile string
+	}
+	matches := []match{}
+	for path, score := range scores {
+		doc := idx.docs[path]
+		if len(q.Roots) > 0 && !slices.Contains(q.Roots, doc.Root) {
+			continue
+		}
+		matches = append(matches, match{result: ContentResult{Root: doc.Root, Path: doc.Path, Score: score}, textFile: filepath.Join(idx.dir, doc.TextFile)})
+	}
+	idx.lock.RUnlock()
+
+	slices.SortFunc(matches, func(a, b match) int {
+		if c := cmp.Compare(b.result.Score, a.result.Score); c != 0 {
+			return c
+		}
+		return strings.Compare(a.result.Path, b.result.Path)
+	})
+	results := []ContentResult{}
+	for _, m := range matches[:min(len(matches), q.Limit)] {
+		m.result.Snippet = getSnippet(m.textFile, q.Terms)
+		results = append(results, m.result)
+	}
+	return results
+}
+
+const snippetContext = 80
+
+// getSnippet cuts out the text around the first match of any of the terms in
+// the extracted text at textPath, highlighting every match inside it.
+func getSnippet(textPath string, terms []string) string {
+	text, err := os.ReadFile(textPath)
+	if err != nil {
+		return ""
+	}
+	quoted := []string{}
+	for _, term := range terms {
+		quoted = append(quoted, regexp.QuoteMeta(term))
+	}
+	match := regexp.MustCompile(`(?i)` + strings.Join(quoted, "|"))
+	first := match.FindIndex(text)
+	if first == nil {
+		return ""
+	}
+
+	start := max(first[0]-snippetContext, 0)
+	end := min(first[1]+snippetContext, len(text))
+	// keep clear of splitting a multibyte character at either end
+	for start > 0 && !isRuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !isRuneStart(text[end]) {
+		end++
+	}
+	window := string(text[start:end])
+
+	snippet := strings.Builder{}
+	last := 0
+	for _, m := range match.FindAllStringIndex(window, -1) {
+		snippet.WriteString(html.EscapeString(window[last:m[0]]))
+		snippet.WriteString("<mark>" + html.EscapeString(window[m[0]:m[1]]) + "</mark>")
+		last = m[1]
+	}
+	snippet.WriteString(html.EscapeString(window[last:]))
+	return strings.Join(strings.Fields(snippet.String()), " ")
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+// SearchContents sends the results of q as a JSON array.
+func SearchContents(q ContentQuery, c chan<- string, cErr chan<- error) {
+	defer close(cErr)
+	defer close(c)
+
+	s, err := json.Marshal(contentIndex.Search(q))
+	if err != nil {
+		cErr <- fmt.Errorf("Error marshalling search results: %s", err.Error())
+		return
+	}
+	c <- string(s)
+}
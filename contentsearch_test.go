@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGetSnippet(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		terms []string
+		want  string
+	}{
+		{"no match", "nothing to see", []string{"term"}, ""},
+		{"match", "find the term here", []string{"term"}, "find the <mark>term</mark> here"},
+		{"any case", "find the TERM here", []string{"term"}, "find the <mark>TERM</mark> here"},
+		{"every term", "one and two", []string{"two", "one"}, "<mark>one</mark> and <mark>two</mark>"},
+		{"every match", "term, term", []string{"term"}, "<mark>term</mark>, <mark>term</mark>"},
+		{"escaped", "<b>term</b> & co", []string{"term"}, "&lt;b&gt;<mark>term</mark>&lt;/b&gt; &amp; co"},
+		{"terms are not patterns", "a.c abc", []string{"a.c"}, "<mark>a.c</mark> abc"},
+		{"whitespace collapsed", "line one\n\n  term\tline", []string{"term"}, "line one <mark>term</mark> line"},
+		{"cut to context", strings.Repeat("x", 100) + " term " + strings.Repeat("y", 100), []string{"term"}, strings.Repeat("x", 79) + " <mark>term</mark> " + strings.Repeat("y", 79)},
+		{"whole characters", "a" + strings.Repeat("é", 50) + "term", []string{"term"}, strings.Repeat("é", 40) + "<mark>term</mark>"},
+	}
+	dir := t.TempDir()
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, string(rune('a'+i)))
+			if err := os.WriteFile(path, []byte(tt.text), 0666); err != nil {
+				t.Fatal(err)
+			}
+			if got := getSnippet(path, tt.terms); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,54 +1,208 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/fs"
 	"os"
+	"path"
+	"path/filepath"
 	"rnas/streaming"
+	"slices"
 	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
 )
 
-func Delete(fullPath string, virtualPath string, streamablePath string, cErr chan error) {
-	fmt.Println("hit delete")
+func Delete(ctx context.Context, fullPath string, virtualPath string, streamablePath string, cErr chan error) {
 	defer close(cErr)
 
+	if rootErr := checkNotRoot(virtualPath); rootErr != nil {
+		cErr <- rootErr
+		return
+	}
 	file, createErr := os.Open(fullPath)
 	if createErr != nil {
 		cErr <- createErr
 		return
 	}
 	if file == nil {
-		cErr <- fmt.Errorf("File at %s does not exist", fullPath)
+		cErr <- newError(codeNotFound, "File at %s does not exist", virtualPath)
+	}
+	info, statErr := file.Stat()
+	file.Close()
+	if statErr != nil {
+		cErr <- statErr
+		return
 	}
 	removeErr := os.Remove(fullPath)
 	if removeErr != nil {
 		cErr <- removeErr
+		return
 	}
+	if info.Mode().IsRegular() {
+		quotas.Removed(fullPath, info.Size())
+		auditBytes(ctx, info.Size())
+	}
+	notifyRemoved(fullPath, info.IsDir())
 
-	_, sanitisedFileName, virtualPathPrefix := streaming.GetStreamStrings(virtualPath)
-	streamDir, streamDirErr := streaming.GetStreamablePath(sanitisedFileName, virtualPathPrefix, streamablePath)
-	if streamDirErr != nil {
-		cErr <- fmt.Errorf("Error reading file or directory: %s", streamDirErr.Error())
+	streamErr := deleteStreamFiles(ctx, virtualPath, streamablePath)
+	if streamErr != nil {
+		cErr <- streamErr
 		return
 	}
-	streamFiles, dirErr := os.ReadDir(*streamDir)
-	if dirErr != nil {
-		cErr <- fmt.Errorf("Error reading streamable path %s for deletion: %s", *streamDir, dirErr.Error())
+
+	filesLog.InfoContext(ctx, "deleted", "path", fullPath)
+}
+
+type DeleteProgress struct {
+	Type  string `json:"type"` // "file" or "directory"
+	Path  string `json:"path"`
+	Error string `json:"error,omitempty"`
+}
+
+// DeleteRecursive removes the directory at fullPath and everything below it,
+// sending a JSON line to cProgress for every entry it attempts to remove.
+// Errors on individual entries are reported on cProgress and do not stop the
+// walk; cErr is only used for errors that prevent the delete from starting.
+func DeleteRecursive(ctx context.Context, fullPath string, virtualPath string, streamablePath string, confirm string, cProgress chan<- string, cErr chan<- error) {
+	defer close(cErr)
+	defer close(cProgress)
+
+	if rootErr := checkNotRoot(virtualPath); rootErr != nil {
+		cErr <- rootErr
 		return
 	}
-	if streamDir == nil {
-		fmt.Println("File should now be deleted at ", fullPath)
+	info, statErr := os.Stat(fullPath)
+	if statErr != nil {
+		cErr <- statErr
+		return
+	}
+	if !info.IsDir() {
+		cErr <- newError(codeBadRequest, "%s is not a directory", virtualPath)
+		return
+	}
+	// confirmed by the name the client asked for, which for a directory
+	// inside a root is always the name it has on disk
+	name := path.Base(virtualPath)
+	if confirm != name {
+		cErr <- newError(codeBadRequest, "Recursive delete of %s must be confirmed with confirm=%s", virtualPath, name)
+		return
+	}
+
+	defer notifyRemoved(fullPath, true)
+
+	entries := []string{}
+	walkErr := filepath.WalkDir(fullPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			sendDeleteProgress(cProgress, DeleteProgress{Type: "directory", Path: toVirtualPath(p, fullPath, virtualPath), Error: err.Error()})
+			return nil
+		}
+		entries = append(entries, p)
+		return nil
+	})
+	if walkErr != nil {
+		cErr <- walkErr
+		return
+	}
+
+	// WalkDir visits parents before children, so walking backwards removes
+	// every directory's contents before the directory itself
+	for _, p := range slices.Backward(entries) {
+		entryVirtualPath := toVirtualPath(p, fullPath, virtualPath)
+		progress := DeleteProgress{Type: "file", Path: entryVirtualPath}
+
+		entryInfo, err := os.Lstat(p)
+		if err != nil {
+			progress.Error = err.Error()
+			sendDeleteProgress(cProgress, progress)
+			continue
+		}
+		isVideo := false
+		if entryInfo.IsDir() {
+			progress.Type = "directory"
+		} else if mime, mimeErr := mimetype.DetectFile(p); mimeErr == nil {
+			isVideo = strings.HasPrefix(mime.String(), "video/")
+		}
+
+		err = os.Remove(p)
+		if err != nil {
+			progress.Error = err.Error()
+			sendDeleteProgress(cProgress, progress)
+			continue
+		}
+		if entryInfo.Mode().IsRegular() {
+			quotas.Removed(p, entryInfo.Size())
+			auditBytes(ctx, entryInfo.Size())
+		}
+		if isVideo {
+			err = deleteStreamFiles(ctx, entryVirtualPath, streamablePath)
+			if err != nil {
+				progress.Error = err.Error()
+			}
+		}
+		sendDeleteProgress(cProgress, progress)
+	}
+
+	// the HLS output tree mirrors the virtual path, so drop whatever is left of it
+	_, _, virtualPathPrefix := streaming.GetStreamStrings(virtualPath)
+	os.Remove(fmt.Sprintf("%s%s/%s", streamablePath, virtualPathPrefix, name))
+
+	filesLog.InfoContext(ctx, "deleted directory", "path", fullPath)
+}
+
+func sendDeleteProgress(c chan<- string, progress DeleteProgress) {
+	s, err := json.Marshal(progress)
+	if err != nil {
+		filesLog.Error("error marshalling delete progress", "error", err)
 		return
 	}
+	c <- string(s)
+}
+
+// checkNotRoot refuses to delete a root, or the list of them, which have to be
+// taken out of the config instead.
+func checkNotRoot(virtualPath string) error {
+	trimmed := strings.Trim(virtualPath, "/")
+	if !strings.Contains(trimmed, "/") {
+		return newError(codeForbidden, "Cannot delete root %s", trimmed)
+	}
+	return nil
+}
+
+// toVirtualPath maps a real path somewhere under baseRealPath back onto the
+// virtual path tree rooted at baseVirtualPath.
+func toVirtualPath(realPath string, baseRealPath string, baseVirtualPath string) string {
+	rel, err := filepath.Rel(baseRealPath, realPath)
+	if err != nil || rel == "." {
+		return baseVirtualPath
+	}
+	return strings.TrimSuffix(baseVirtualPath, "/") + "/" + filepath.ToSlash(rel)
+}
+
+// deleteStreamFiles removes any HLS output generated for the video at virtualPath.
+func deleteStreamFiles(ctx context.Context, virtualPath string, streamablePath string) error {
+	_, sanitisedFileName, virtualPathPrefix := streaming.GetStreamStrings(virtualPath)
+	streamDir, streamDirErr := streaming.GetStreamablePath(ctx, sanitisedFileName, virtualPathPrefix, streamablePath)
+	if streamDirErr != nil {
+		return fmt.Errorf("Error reading file or directory: %s", streamDirErr.Error())
+	}
+	if streamDir == nil {
+		return nil
+	}
+	streamFiles, dirErr := os.ReadDir(*streamDir)
+	if dirErr != nil {
+		return fmt.Errorf("Error reading streamable path %s for deletion: %s", *streamDir, dirErr.Error())
+	}
 	for _, f := range streamFiles {
 		if !strings.HasPrefix(f.Name(), sanitisedFileName) {
 			continue
 		}
 		removeErr := os.Remove(*streamDir + "/" + f.Name())
 		if removeErr != nil {
-			cErr <- fmt.Errorf("Error deleting streaming file for deleted file %s at %s: %s", f.Name(), *streamDir, removeErr.Error())
-			return
+			return fmt.Errorf("Error deleting streaming file for deleted file %s at %s: %s", f.Name(), *streamDir, removeErr.Error())
 		}
 	}
-
-	fmt.Println("Streaming file should now be deleted at ", fullPath)
+	return nil
 }
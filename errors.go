@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Error codes sent in the "code" field of every error response.
+const (
+	codeBadRequest         = "bad_request"
+	codeNotFound           = "not_found"
+	codeMethodNotAllowed   = "method_not_allowed"
+	codeConflict           = "conflict"
+	codeUnauthorized       = "unauthorized"
+	codeForbidden          = "forbidden"
+	codeGone               = "gone"
+	codePreconditionFailed = "precondition_failed"
+	codeTooLarge           = "too_large"
+	codeUnsupportedType    = "unsupported_type"
+	codeQuotaExceeded      = "quota_exceeded"
+	codeTranscodeFailed    = "transcode_failed"
+	codeInternal           = "internal"
+)
+
+var errorStatuses = map[string]int{
+	codeBadRequest:         http.StatusBadRequest,
+	codeNotFound:           http.StatusNotFound,
+	codeMethodNotAllowed:   http.StatusMethodNotAllowed,
+	codeConflict:           http.StatusConflict,
+	codeUnauthorized:       http.StatusUnauthorized,
+	codeForbidden:          http.StatusForbidden,
+	codeGone:               http.StatusGone,
+	codePreconditionFailed: http.StatusPreconditionFailed,
+	codeTooLarge:           http.StatusRequestEntityTooLarge,
+	codeUnsupportedType:    http.StatusUnsupportedMediaType,
+	codeQuotaExceeded:      http.StatusInsufficientStorage,
+	codeTranscodeFailed:    http.StatusBadGateway,
+	codeInternal:           http.StatusInternalServerError,
+}
+
+// Trailers declared on every streamed response. A stream only completed if
+// X-Stream-Status is "complete"; anything else, including the trailer being
+// missing, means the body was cut short.
+const (
+	trailerStreamStatus = "X-Stream-Status"
+	trailerErrorCode    = "X-Error-Code"
+	trailerErrorMessage = "X-Error-Message"
+)
+
+type APIError struct {
+	Code    string
+	Message string
+	Err     error
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// newError formats an error like fmt.Errorf, tagging it with one of the error
+// codes. Any error wrapped with %w can still be found with errors.Is/As.
+func newError(code string, format string, a ...any) error {
+	err := fmt.Errorf(format, a...)
+	return &APIError{Code: code, Message: err.Error(), Err: errors.Unwrap(err)}
+}
+
+// getErrorCode finds the code for err, falling back on the kind of filesystem
+// error underneath it for errors that were never tagged.
+func getErrorCode(err error) string {
+	apiErr := &APIError{}
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	maxBytesErr := &http.MaxBytesError{}
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return codeTooLarge
+	case errors.Is(err, fs.ErrNotExist):
+		return codeNotFound
+	case errors.Is(err, fs.ErrExist):
+		return codeConflict
+	case errors.Is(err, fs.ErrPermission):
+		return codeForbidden
+	}
+	return codeInternal
+}
+
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+type ErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeError responds with err in the JSON error envelope. It must be called
+// before anything else has been written to w.
+func writeError(w http.ResponseWriter, err error) {
+	code := getErrorCode(err)
+	logResponseError(w, code, err)
+	s, jsonErr := json.Marshal(ErrorResponse{Error: ErrorBody{Code: code, Message: clientMessage(err)}})
+	if jsonErr != nil {
+		s = []byte(fmt.Sprintf(`{"error":{"code":"%s","message":""}}`, code))
+	}
+	w.Header().Del("Trailer")
+	w.Header().Del("ETag")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(errorStatuses[code])
+	w.Write(s)
+}
+
+// clientMessage is the message for err sent to clients, which see the paths of
+// filesystem errors as virtual paths. The logs keep the real ones.
+func clientMessage(err error) string {
+	message := err.Error()
+	pathErr := &fs.PathError{}
+	if errors.As(err, &pathErr) {
+		message = strings.ReplaceAll(message, pathErr.Path, clientPath(pathErr.Path))
+	}
+	linkErr := &os.LinkError{}
+	if errors.As(err, &linkErr) {
+		message = strings.ReplaceAll(message, linkErr.Old, clientPath(linkErr.Old))
+		message = strings.ReplaceAll(message, linkErr.New, clientPath(linkErr.New))
+	}
+	return message
+}
+
+// clientPath is the virtual path of the real path realPath, for telling
+// clients about it. Paths outside the roots only give away their name.
+func clientPath(realPath string) string {
+	rootName, rootPath, ok := getRootOf(getSettings().BasePaths, filepath.Clean(realPath))
+	if !ok {
+		return filepath.Base(realPath)
+	}
+	return toVirtualPath(filepath.Clean(realPath), rootPath, "/"+rootName)
+}
+
+// logResponseError logs an error sent in a response: as an error if it is
+// the server's fault, or for debugging if it is the client's, and remembers
+// it for the audit log. The request ID is read back from the response
+// headers.
+func logResponseError(w http.ResponseWriter, code string, err error) {
+	if recorder := responseRecorder(w); recorder != nil {
+		recorder.err = err
+	}
+	ctx := withRequestID(context.Background(), w.Header().Get(requestIDHeader))
+	if errorStatuses[code] >= http.StatusInternalServerError {
+		httpLog.ErrorContext(ctx, "error", "code", code, "error", err)
+	} else {
+		httpLog.DebugContext(ctx, "error", "code", code, "error", err)
+	}
+}
+
+// declareStreamTrailers must be called before the first write of a streamed
+// response so that finishStream can report how the stream ended.
+func declareStreamTrailers(w http.ResponseWriter) {
+	w.Header().Set("Trailer", strings.Join([]string{trailerStreamStatus, trailerErrorCode, trailerErrorMessage}, ", "))
+}
+
+// finishStream sets the trailers for a stream that ended with err, or that
+// completed if err is nil.
+func finishStream(w http.ResponseWriter, err error) {
+	if err == nil {
+		w.Header().Set(trailerStreamStatus, "complete")
+		return
+	}
+	logResponseError(w, getErrorCode(err), err)
+	w.Header().Set(trailerStreamStatus, "error")
+	w.Header().Set(trailerErrorCode, getErrorCode(err))
+	w.Header().Set(trailerErrorMessage, strings.Join(strings.Fields(clientMessage(err)), " "))
+}
+
+// writeStreamError reports an error on a streamed response, as a normal error
+// response if nothing has been sent yet or through the trailers if it has.
+func writeStreamError(w http.ResponseWriter, flusher http.Flusher, err error, started bool) {
+	if !started {
+		writeError(w, err)
+	} else {
+		finishStream(w, err)
+	}
+	flusher.Flush()
+}
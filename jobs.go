@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of background job.
+const (
+	jobExtract  = "extract"
+	jobCompress = "compress"
+)
+
+// States a job can be in.
+const (
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// Job is an extraction or compression running in the background. Bytes counts
+// how much has been unpacked or packed so far, out of TotalBytes.
+type Job struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	Source     string `json:"source"` // virtual path
+	Target     string `json:"target"` // virtual path
+	Status     string `json:"status"`
+	Entries    int    `json:"entries"`
+	Bytes      int64  `json:"bytes"`
+	TotalBytes int64  `json:"totalBytes"`
+	Error      string `json:"error,omitempty"`
+	Started    int    `json:"started"`
+	Finished   int    `json:"finished,omitempty"`
+}
+
+type runningJob struct {
+	job    Job
+	cancel context.CancelFunc
+}
+
+// maxFinishedJobs is how many finished jobs are remembered for clients to
+// check on. Older ones are forgotten as new jobs finish. It is set from the
+// config.
+var maxFinishedJobs = 100
+
+var jobsLock = sync.RWMutex{}
+var jobs = map[string]*runningJob{}
+
+func getJob(id string) (Job, bool) {
+	jobsLock.RLock()
+	defer jobsLock.RUnlock()
+	j, ok := jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return j.job, true
+}
+
+func updateJob(id string, update func(job *Job)) {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	if j, ok := jobs[id]; ok {
+		update(&j.job)
+	}
+}
+
+// finishJob records how a job ended and forgets the oldest finished jobs.
+func finishJob(id string, err error) {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	j, ok := jobs[id]
+	if !ok {
+		return
+	}
+	j.job.Finished = int(time.Now().Unix())
+	switch {
+	case err == nil:
+		j.job.Status = jobDone
+	case errors.Is(err, context.Canceled):
+		j.job.Status = jobCancelled
+	default:
+		j.job.Status = jobFailed
+		j.job.Error = err.Error()
+	}
+	jobsLog.Info("job finished", "id", id, "type", j.job.Type, "source", j.job.Source, "status", j.job.Status, "error", j.job.Error)
+
+	finished := []*runningJob{}
+	for _, other := range jobs {
+		if other.job.Status != jobRunning {
+			finished = append(finished, other)
+		}
+	}
+	if len(finished) > maxFinishedJobs {
+		slices.SortFunc(finished, func(a, b *runningJob) int { return a.job.Finished - b.job.Finished })
+		for _, old := range finished[:len(finished)-maxFinishedJobs] {
+			delete(jobs, old.job.ID)
+		}
+	}
+}
+
+// resolveVirtualPath maps a virtual path onto the real path it stands for,
+// with the same rules as requests for files: the path must be inside a root
+// and can't reach rnas's internal entries.
+func resolveVirtualPath(basePaths map[string]string, virtualPath string) (string, string, string, error) {
+	virtualPath = path.Clean("/" + virtualPath)
+	parts := strings.Split(virtualPath, "/")
+	rootPath, ok := basePaths[parts[1]]
+	if !ok || slices.ContainsFunc(parts, isHiddenEntry) {
+		return "", "", "", newError(codeNotFound, "Path %s not found!", virtualPath)
+	}
+	return parts[1], rootPath, strings.Join(slices.Concat([]string{rootPath}, parts[2:]), "/"), nil
+}
+
+// checkInsideRoot makes sure the directory at dir really is inside rootPath
+// once symlinks are followed, so nothing can be written outside the root
+// through a link in it.
+func checkInsideRoot(rootPath string, dir string) error {
+	realRoot, rootErr := filepath.EvalSymlinks(rootPath)
+	if rootErr != nil {
+		return rootErr
+	}
+	realDir, dirErr := filepath.EvalSymlinks(dir)
+	if dirErr != nil {
+		return dirErr
+	}
+	if realDir != realRoot && !strings.HasPrefix(realDir, realRoot+string(filepath.Separator)) {
+		return newError(codeForbidden, "%s is outside of its root", clientPath(dir))
+	}
+	return nil
+}
+
+// jobReader counts what is read through it towards a job's progress, and
+// stops the job once it has been cancelled.
+type jobReader struct {
+	r   io.Reader
+	ctx context.Context
+	id  string
+}
+
+func (r jobReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	updateJob(r.id, func(job *Job) { job.Bytes += int64(n) })
+	return n, err
+}
+
+// StartJob checks a job's paths and starts it in the background, sending the
+// new Job as JSON. conflict is the policy for files that already exist, as for
+// uploads, except that nothing can be overwritten since a job has no way to
+// say which versions it expects to replace. What the job writes counts towards
+// user's quota, and it won't start if that would go over.
+func StartJob(basePaths map[string]string, jobType string, source string, target string, conflict string, retention VersionRetention, user string, c chan<- string, cErr chan<- error) {
+	defer close(cErr)
+	defer close(c)
+
+	if conflict == "" {
+		conflict = conflictError
+	}
+	if conflict != conflictError && conflict != conflictRename {
+		cErr <- newError(codeBadRequest, "Jobs can only use the %s or %s conflict policies", conflictError, conflictRename)
+		return
+	}
+	_, _, sourcePath, sourceErr := resolveVirtualPath(basePaths, source)
+	if sourceErr != nil {
+		cErr <- sourceErr
+		return
+	}
+	targetRootName, targetRootPath, targetPath, targetErr := resolveVirtualPath(basePaths, target)
+	if targetErr != nil {
+		cErr <- targetErr
+		return
+	}
+	if targetPath == targetRootPath && jobType == jobCompress {
+		cErr <- newError(codeBadRequest, "Target must be a file inside %s", "/"+targetRootName)
+		return
+	}
+	sourceInfo, statErr := os.Stat(sourcePath)
+	if statErr != nil {
+		cErr <- fmt.Errorf("Error reading file or directory: %w", statErr)
+		return
+	}
+
+	var run func(ctx context.Context, id string) error
+	job := Job{Type: jobType, Source: path.Clean("/" + source), Target: path.Clean("/" + target), Status: jobRunning, Started: int(time.Now().Unix())}
+	switch jobType {
+	case jobExtract:
+		if !sourceInfo.Mode().IsRegular() || !isBrowsableArchive(sourcePath) {
+			cErr <- newError(codeBadRequest, "%s is not an archive that can be extracted", job.Source)
+			return
+		}
+		index, indexErr := getArchiveIndex(sourcePath)
+		if indexErr != nil {
+			cErr <- newError(codeBadRequest, "Error reading archive: %w", indexErr)
+			return
+		}
+		if conflict == conflictError {
+			for name, member := range index.members {
+				if _, err := os.Lstat(filepath.Join(targetPath, filepath.FromSlash(name))); err == nil && !member.info.IsDir() {
+					cErr <- newError(codeConflict, "File with name %s already exists in directory", name)
+					return
+				}
+			}
+		}
+		files := 0
+		for _, member := range index.members {
+			job.TotalBytes += member.info.Size()
+			if !member.info.IsDir() {
+				files++
+			}
+		}
+		quotaErr := quotas.Check(targetRootPath, user, job.TotalBytes, files)
+		if quotaErr != nil {
+			cErr <- quotaErr
+			return
+		}
+		run = func(ctx context.Context, id string) error {
+			return extractArchive(ctx, id, sourcePath, targetRootPath, targetPath, conflict, retention, user)
+		}
+	case jobCompress:
+		format := ""
+		for _, f := range []string{archiveZip, archiveTarGz, archiveTar} {
+			if strings.HasSuffix(strings.ToLower(targetPath), "."+f) {
+				format = f
+				break
+			}
+		}
+		if strings.HasSuffix(strings.ToLower(targetPath), ".tgz") {
+			format = archiveTarGz
+		}
+		if format == "" {
+			cErr <- newError(codeBadRequest, "Target %s must end in .zip, .tar or .tar.gz", job.Target)
+			return
+		}
+		if !sourceInfo.IsDir() {
+			cErr <- newError(codeBadRequest, "%s is not a directory", job.Source)
+			return
+		}
+		job.TotalBytes = getTreeSize(sourcePath)
+		// the archive is taken to be as big as what goes in it, which it rarely exceeds
+		quotaErr := quotas.Check(targetRootPath, user, job.TotalBytes, 1)
+		if quotaErr != nil {
+			cErr <- quotaErr
+			return
+		}
+		run = func(ctx context.Context, id string) error {
+			return compressDir(ctx, id, sourcePath, path.Base(job.Source), format, targetRootPath, targetPath, conflict, retention, user)
+		}
+	default:
+		cErr <- newError(codeBadRequest, "Unknown job type %s", jobType)
+		return
+	}
+
+	id, idErr := newTrashID()
+	if idErr != nil {
+		cErr <- fmt.Errorf("Error creating job: %s", idErr.Error())
+		return
+	}
+	job.ID = id
+	ctx, cancel := context.WithCancel(context.Background())
+	jobsLock.Lock()
+	jobs[id] = &runningJob{job: job, cancel: cancel}
+	jobsLock.Unlock()
+	go func() {
+		defer cancel()
+		finishJob(id, run(ctx, id))
+	}()
+
+	s, err := json.Marshal(job)
+	if err != nil {
+		cErr <- fmt.Errorf("Error marshalling job: %s", err.Error())
+		return
+	}
+	c <- string(s)
+}
+
+// extractArchive unpacks the archive at archivePath into the directory at
+// targetPath, creating it if need be. Members are placed with the same rules
+// as any other path, so none can land outside the target's root.
+func extractArchive(ctx context.Context, id string, archivePath string, rootPath string, targetPath string, conflict string, retention VersionRetention, user string) error {
+	made, mkdirErr := mkdirInsideRoot(rootPath, targetPath)
+	if mkdirErr != nil {
+		return mkdirErr
+	}
+	if made != "" {
+		notifyChanged(changeCreate, made)
+	}
+
+	return walkArchive(archivePath, func(name string, info fs.FileInfo, r io.Reader) (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		parts := strings.Split(name, "/")
+		if slices.ContainsFunc(parts, isHiddenEntry) {
+			return true, nil
+		}
+		memberPath := filepath.Join(targetPath, filepath.FromSlash(name))
+		dir := memberPath
+		if !info.IsDir() {
+			dir = filepath.Dir(memberPath)
+		}
+		made, mkdirErr := mkdirInsideRoot(rootPath, dir)
+		if mkdirErr != nil {
+			return false, mkdirErr
+		}
+		if made != "" {
+			notifyChanged(changeCreate, made)
+		}
+		if !info.IsDir() {
+			written, writeErr := writeFileAtomic(dir, path.Base(name), jobReader{r: r, ctx: ctx, id: id}, conflict, rootPath, retention, user)
+			if writeErr != nil {
+				return false, writeErr
+			}
+			os.Chtimes(written, info.ModTime(), info.ModTime())
+		}
+		updateJob(id, func(job *Job) { job.Entries++ })
+		return true, nil
+	})
+}
+
+// mkdirInsideRoot creates the directory at dir and any missing parents after
+// checking that the closest existing one is inside rootPath. It returns the
+// topmost directory it created, if any.
+func mkdirInsideRoot(rootPath string, dir string) (string, error) {
+	existing := dir
+	for {
+		if _, err := os.Stat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		existing = parent
+	}
+	insideErr := checkInsideRoot(rootPath, existing)
+	if insideErr != nil {
+		return "", insideErr
+	}
+	if existing == dir {
+		return "", nil
+	}
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return "", err
+	}
+	rel, _ := filepath.Rel(existing, dir)
+	return filepath.Join(existing, strings.Split(rel, string(filepath.Separator))[0]), nil
+}
+
+// compressDir packs the directory at sourcePath into a new archive at
+// targetPath, under a folder named prefix, creating the target's directory if
+// need be.
+func compressDir(ctx context.Context, id string, sourcePath string, prefix string, format string, rootPath string, targetPath string, conflict string, retention VersionRetention, user string) error {
+	dir := filepath.Dir(targetPath)
+	made, mkdirErr := mkdirInsideRoot(rootPath, dir)
+	if mkdirErr != nil {
+		return mkdirErr
+	}
+	if made != "" {
+		notifyChanged(changeCreate, made)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		archive := newArchiveWriter(format, pw)
+		err := addArchiveTree(archive, sourcePath, prefix, []string{"."}, ArchiveOptions{}, func(r io.Reader) io.Reader {
+			updateJob(id, func(job *Job) { job.Entries++ })
+			return jobReader{r: r, ctx: ctx, id: id}
+		})
+		if err == nil {
+			err = archive.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	_, err := writeFileAtomic(dir, filepath.Base(targetPath), pr, conflict, rootPath, retention, user)
+	pr.CloseWithError(err)
+	return err
+}
+
+// ListJobs sends every job that is running or recently finished as a JSON
+// array, oldest first.
+func ListJobs(c chan<- string, cErr chan<- error) {
+	defer close(cErr)
+	defer close(c)
+
+	jobsLock.RLock()
+	list := []Job{}
+	for _, j := range jobs {
+		list = append(list, j.job)
+	}
+	jobsLock.RUnlock()
+	slices.SortFunc(list, func(a, b Job) int { return strings.Compare(a.ID, b.ID) })
+
+	s, err := json.Marshal(list)
+	if err != nil {
+		cErr <- fmt.Errorf("Error marshalling jobs: %s", err.Error())
+		return
+	}
+	c <- string(s)
+}
+
+// ReadJob sends the job with the given ID as JSON.
+func ReadJob(id string, c chan<- string, cErr chan<- error) {
+	defer close(cErr)
+	defer close(c)
+
+	job, ok := getJob(id)
+	if !ok {
+		cErr <- newError(codeNotFound, "Job %s not found", id)
+		return
+	}
+	s, err := json.Marshal(job)
+	if err != nil {
+		cErr <- fmt.Errorf("Error marshalling job: %s", err.Error())
+		return
+	}
+	c <- string(s)
+}
+
+// CancelJob stops the job with the given ID if it is still running. Anything
+// it has already extracted is left in place.
+func CancelJob(id string, cErr chan<- error) {
+	defer close(cErr)
+
+	jobsLock.RLock()
+	j, ok := jobs[id]
+	jobsLock.RUnlock()
+	if !ok {
+		cErr <- newError(codeNotFound, "Job %s not found", id)
+		return
+	}
+	j.cancel()
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// Sort keys accepted by the sort query parameter on directory listings.
+const (
+	sortName     = "name"
+	sortSize     = "size"
+	sortModified = "modified"
+	sortType     = "type"
+)
+
+type ListOptions struct {
+	Sort   string // empty if no order was asked for, which sorts by name
+	Desc   bool
+	Mime   string // mime type prefix, e.g. "image/" or "image/png"
+	Glob   string
+	Limit  int
+	Cursor *listCursor
+	NDJSON bool
+	Depth  int  // levels of subdirectories to include as children, 1 for none
+	Browse bool // read an archive as a directory of its members
+}
+
+// maxListDepth caps how deep a recursive listing can go in one request.
+const maxListDepth = 32
+
+// Paged reports whether the listing should be sent as a page, in the form
+// {"items": [...], "next": "<cursor>"}, rather than as a bare array.
+func (o ListOptions) Paged() bool {
+	return o.Limit > 0 || o.Cursor != nil
+}
+
+// Ordered reports whether the whole directory has to be read before any of
+// the listing can be sent.
+func (o ListOptions) Ordered() bool {
+	return o.Sort != "" || o.Paged()
+}
+
+// ListSummary is the last line of an NDJSON listing.
+type ListSummary struct {
+	Type   string      `json:"type"` // should always be "summary"
+	Count  int         `json:"count"`
+	Size   int         `json:"size"`
+	Next   string      `json:"next,omitempty"`
+	Errors []ListError `json:"errors"`
+}
+type ListError struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// listCursor is the position of the last entry on a page. The next page starts
+// at the first entry that sorts after it, so entries added or removed between
+// requests don't shift the pages around.
+type listCursor struct {
+	Name     string `json:"n"`
+	Dir      bool   `json:"d,omitempty"`
+	Size     int64  `json:"s,omitempty"`
+	Modified int64  `json:"m,omitempty"`
+	Mime     string `json:"t,omitempty"`
+}
+
+type listEntry struct {
+	info os.FileInfo
+	path string
+	mime string
+}
+
+func parseListOptions(query url.Values, accept string) (ListOptions, error) {
+	opts := ListOptions{Mime: query.Get("mime"), Glob: query.Get("glob"), NDJSON: strings.Contains(accept, "application/x-ndjson"), Depth: 1, Browse: query.Has("browse")}
+
+	if sort := query.Get("sort"); sort != "" {
+		if !slices.Contains([]string{sortName, sortSize, sortModified, sortType}, sort) {
+			return opts, newError(codeBadRequest, "Unknown sort %s", sort)
+		}
+		opts.Sort = sort
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return opts, newError(codeBadRequest, "Unknown order %s", query.Get("order"))
+	}
+	opts.Mime = strings.TrimSuffix(opts.Mime, "*")
+	if opts.Glob != "" {
+		if _, err := filepath.Match(opts.Glob, ""); err != nil {
+			return opts, newError(codeBadRequest, "Invalid glob %s", opts.Glob)
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return opts, newError(codeBadRequest, "Invalid limit %s", limit)
+		}
+		opts.Limit = n
+	}
+	if depth := query.Get("depth"); depth != "" {
+		n, err := strconv.Atoi(depth)
+		if err != nil || n < 1 || n > maxListDepth {
+			return opts, newError(codeBadRequest, "Depth must be between 1 and %d", maxListDepth)
+		}
+		opts.Depth = n
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		s, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return opts, newError(codeBadRequest, "Invalid cursor")
+		}
+		opts.Cursor = &listCursor{}
+		if jsonErr := json.Unmarshal(s, opts.Cursor); jsonErr != nil {
+			return opts, newError(codeBadRequest, "Invalid cursor")
+		}
+	}
+	return opts, nil
+}
+
+// getListPage filters and sorts the entries of the directory at path and cuts
+// out the page asked for in opts, returning it along with the cursor for the
+// next page. Mime types are only detected where the options need them.
+func getListPage(path string, files []os.FileInfo, opts ListOptions) ([]listEntry, string) {
+	entries := []listEntry{}
+	for _, file := range files {
+		entry, ok := getListEntry(path, file, opts)
+		if ok {
+			entries = append(entries, entry)
+		}
+	}
+
+	slices.SortFunc(entries, func(a, b listEntry) int {
+		return compareListCursors(toListCursor(a), toListCursor(b), opts)
+	})
+
+	if opts.Cursor != nil {
+		start, _ := slices.BinarySearchFunc(entries, *opts.Cursor, func(e listEntry, c listCursor) int {
+			if compareListCursors(toListCursor(e), c, opts) <= 0 {
+				return -1
+			}
+			return 1
+		})
+		entries = entries[start:]
+	}
+
+	next := ""
+	if opts.Limit > 0 && len(entries) > opts.Limit {
+		entries = entries[:opts.Limit]
+		last := toListCursor(entries[len(entries)-1])
+		if s, err := json.Marshal(last); err == nil {
+			next = base64.RawURLEncoding.EncodeToString(s)
+		}
+	}
+	return entries, next
+}
+
+// getListEntry returns the entry for file, or false if the options filter it
+// out of the listing.
+func getListEntry(path string, file os.FileInfo, opts ListOptions) (listEntry, bool) {
+	entry := listEntry{info: file, path: filepath.Join(path, file.Name())}
+	if opts.Glob != "" {
+		if matched, _ := filepath.Match(opts.Glob, file.Name()); !matched {
+			return entry, false
+		}
+	}
+	if (opts.Mime != "" || opts.Sort == sortType) && !file.IsDir() {
+		entry.mime = getMimeType(entry.path, file)
+	}
+	if opts.Mime != "" && (file.IsDir() || !strings.HasPrefix(entry.mime, opts.Mime)) {
+		return entry, false
+	}
+	return entry, true
+}
+
+// getListEntryJSON marshals the DirInfo or FileInfo for an entry. Directories
+// carry their own listing as children down to the depth in opts.
+func getListEntryJSON(entry listEntry, opts ListOptions) ([]byte, error) {
+	file := entry.info
+	if file.IsDir() {
+		dirInfo, dirErr := getDirInfo(file.Name(), entry.path)
+		if dirErr != nil {
+			return nil, dirErr
+		}
+		if opts.Depth > 1 {
+			children, childErr := getListChildren(entry.path, opts)
+			if childErr != nil {
+				return nil, childErr
+			}
+			dirInfo.Children = children
+		}
+		s, err := json.Marshal(dirInfo)
+		if err != nil {
+			return nil, fmt.Errorf("Error marshalling directory info: %s", err.Error())
+		}
+		return s, nil
+	}
+	mime := entry.mime
+	if mime == "" {
+		mime = getMimeType(entry.path, file)
+	}
+	s, err := json.Marshal(FileInfo{Type: "file", MimeType: mime, Name: file.Name(), Size: int(file.Size()), Modified: int(file.ModTime().Unix()), ETag: getETag(file)})
+	if err != nil {
+		return nil, fmt.Errorf("Error marshalling file info: %s", err.Error())
+	}
+	return s, nil
+}
+
+// getListChildren lists the directory at path one level further down, with the
+// same sort and filters as its parent but never paged.
+func getListChildren(path string, opts ListOptions) ([]json.RawMessage, error) {
+	childOpts := opts
+	childOpts.Depth--
+	childOpts.Limit = 0
+	childOpts.Cursor = nil
+
+	dirEntries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading directory: %w", err)
+	}
+	files := []os.FileInfo{}
+	for _, dirEntry := range dirEntries {
+		if isHiddenEntry(dirEntry.Name()) {
+			continue
+		}
+		if file, infoErr := dirEntry.Info(); infoErr == nil {
+			files = append(files, file)
+		}
+	}
+	entries, _ := getListPage(path, files, childOpts)
+	children := []json.RawMessage{}
+	for _, entry := range entries {
+		s, err := getListEntryJSON(entry, childOpts)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, s)
+	}
+	return children, nil
+}
+
+func toListCursor(e listEntry) listCursor {
+	return listCursor{Name: e.info.Name(), Dir: e.info.IsDir(), Size: e.info.Size(), Modified: e.info.ModTime().Unix(), Mime: e.mime}
+}
+
+// compareListCursors orders entries with directories first, then by the
+// chosen sort key, falling back on the name so the order is always total.
+func compareListCursors(a, b listCursor, opts ListOptions) int {
+	if a.Dir != b.Dir {
+		if a.Dir {
+			return -1
+		}
+		return 1
+	}
+	c := 0
+	switch opts.Sort {
+	case sortSize:
+		c = cmp.Compare(a.Size, b.Size)
+	case sortModified:
+		c = cmp.Compare(a.Modified, b.Modified)
+	case sortType:
+		c = strings.Compare(a.Mime, b.Mime)
+	}
+	if c == 0 {
+		c = strings.Compare(a.Name, b.Name)
+	}
+	if opts.Desc {
+		return -c
+	}
+	return c
+}
+
+type mimeCacheEntry struct {
+	modified int64
+	size     int64
+	mime     string
+}
+
+// mimeCacheMaxEntries bounds the mime cache, which is simply emptied when it
+// fills up. It is set from the config.
+var mimeCacheMaxEntries = 100000
+
+var mimeCacheLock = sync.RWMutex{}
+var mimeCache = map[string]mimeCacheEntry{}
+
+// getMimeType detects the mime type of the file at path, reusing the last
+// result for as long as the file's size and modification time are unchanged.
+func getMimeType(path string, info os.FileInfo) string {
+	mimeCacheLock.RLock()
+	cached, ok := mimeCache[path]
+	mimeCacheLock.RUnlock()
+	if ok && cached.modified == info.ModTime().UnixNano() && cached.size == info.Size() {
+		return cached.mime
+	}
+
+	mime, err := mimetype.DetectFile(path)
+	if err != nil {
+		return ""
+	}
+
+	mimeCacheLock.Lock()
+	if len(mimeCache) >= mimeCacheMaxEntries {
+		mimeCache = map[string]mimeCacheEntry{}
+	}
+	mimeCache[path] = mimeCacheEntry{modified: info.ModTime().UnixNano(), size: info.Size(), mime: mime.String()}
+	mimeCacheLock.Unlock()
+	return mime.String()
+}
+
+// forgetMimeType drops the cached mime types of path and anything below it.
+func forgetMimeType(path string) {
+	prefix := path + string(filepath.Separator)
+	mimeCacheLock.Lock()
+	defer mimeCacheLock.Unlock()
+	delete(mimeCache, path)
+	for cached := range mimeCache {
+		if strings.HasPrefix(cached, prefix) {
+			delete(mimeCache, cached)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+type testFileInfo struct {
+	name     string
+	dir      bool
+	size     int64
+	modified int64
+}
+
+func (f testFileInfo) Name() string       { return f.name }
+func (f testFileInfo) Size() int64        { return f.size }
+func (f testFileInfo) ModTime() time.Time { return time.Unix(f.modified, 0) }
+func (f testFileInfo) IsDir() bool        { return f.dir }
+func (f testFileInfo) Sys() any           { return nil }
+func (f testFileInfo) Mode() os.FileMode {
+	if f.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func TestGetListPage(t *testing.T) {
+	files := []os.FileInfo{
+		testFileInfo{name: "d.txt", size: 1, modified: 300},
+		testFileInfo{name: "b", dir: true, modified: 100},
+		testFileInfo{name: "c.txt", size: 3, modified: 200},
+		testFileInfo{name: "a", dir: true, modified: 400},
+		testFileInfo{name: "e.txt", size: 2, modified: 200},
+	}
+	tests := []struct {
+		name     string
+		opts     ListOptions
+		want     []string
+		wantNext bool
+	}{
+		{"directories first then by name", ListOptions{}, []string{"a", "b", "c.txt", "d.txt", "e.txt"}, false},
+		{"by name descending", ListOptions{Sort: sortName, Desc: true}, []string{"b", "a", "e.txt", "d.txt", "c.txt"}, false},
+		{"by size", ListOptions{Sort: sortSize}, []string{"a", "b", "d.txt", "e.txt", "c.txt"}, false},
+		{"by modified, ties by name", ListOptions{Sort: sortModified}, []string{"b", "a", "c.txt", "e.txt", "d.txt"}, false},
+		{"glob", ListOptions{Glob: "*.txt"}, []string{"c.txt", "d.txt", "e.txt"}, false},
+		{"first page", ListOptions{Limit: 2}, []string{"a", "b"}, true},
+		{"last page exactly filled", ListOptions{Limit: 5}, []string{"a", "b", "c.txt", "d.txt", "e.txt"}, false},
+		{"after a cursor", ListOptions{Limit: 2, Cursor: &listCursor{Name: "b", Dir: true}}, []string{"c.txt", "d.txt"}, true},
+		{"after a cursor for an entry that has gone", ListOptions{Limit: 2, Cursor: &listCursor{Name: "cc.txt", Size: 5}}, []string{"d.txt", "e.txt"}, false},
+		{"after the last entry", ListOptions{Cursor: &listCursor{Name: "e.txt", Size: 2}}, []string{}, false},
+		{"after a cursor by size", ListOptions{Sort: sortSize, Cursor: &listCursor{Name: "d.txt", Size: 1}}, []string{"e.txt", "c.txt"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, next := getListPage("/tmp", files, tt.opts)
+			names := []string{}
+			for _, e := range entries {
+				names = append(names, e.info.Name())
+			}
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("got %v, want %v", names, tt.want)
+			}
+			if (next != "") != tt.wantNext {
+				t.Errorf("got next %q, want one: %v", next, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestGetListPageFollowsCursor(t *testing.T) {
+	files := []os.FileInfo{}
+	for _, name := range []string{"f", "e", "d", "c", "b", "a"} {
+		files = append(files, testFileInfo{name: name})
+	}
+	opts := ListOptions{Limit: 4}
+	page, next := getListPage("/tmp", files, opts)
+	if len(page) != 4 || next == "" {
+		t.Fatalf("got %d entries and next %q on the first page", len(page), next)
+	}
+	opts.Cursor = &listCursor{}
+	*opts.Cursor = toListCursor(page[len(page)-1])
+	page, next = getListPage("/tmp", files, opts)
+	if len(page) != 2 || page[0].info.Name() != "e" || next != "" {
+		t.Errorf("got %d entries starting at %s and next %q on the second page", len(page), page[0].info.Name(), next)
+	}
+}
+
+func TestCompareListCursors(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b listCursor
+		opts ListOptions
+		want int
+	}{
+		{"same", listCursor{Name: "a"}, listCursor{Name: "a"}, ListOptions{}, 0},
+		{"by name", listCursor{Name: "a"}, listCursor{Name: "b"}, ListOptions{}, -1},
+		{"directory before file", listCursor{Name: "z", Dir: true}, listCursor{Name: "a"}, ListOptions{}, -1},
+		{"directory before file descending", listCursor{Name: "z", Dir: true}, listCursor{Name: "a"}, ListOptions{Desc: true}, -1},
+		{"by size", listCursor{Name: "a", Size: 2}, listCursor{Name: "b", Size: 1}, ListOptions{Sort: sortSize}, 1},
+		{"by size descending", listCursor{Name: "a", Size: 2}, listCursor{Name: "b", Size: 1}, ListOptions{Sort: sortSize, Desc: true}, -1},
+		{"size tie by name", listCursor{Name: "b", Size: 1}, listCursor{Name: "a", Size: 1}, ListOptions{Sort: sortSize}, 1},
+		{"by modified", listCursor{Name: "a", Modified: 1}, listCursor{Name: "b", Modified: 2}, ListOptions{Sort: sortModified}, -1},
+		{"by type", listCursor{Name: "a", Mime: "text/plain"}, listCursor{Name: "b", Mime: "image/png"}, ListOptions{Sort: sortType}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := compareListCursors(tt.a, tt.b, tt.opts); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
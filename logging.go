@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"rnas/content"
+	"rnas/streaming"
+	"slices"
+	"sync"
+	"time"
+)
+
+// logSubsystems are the parts of rnas that log, each at its own level.
+var logSubsystems = []string{"server", "http", "files", "streaming", "index", "trash", "versions", "jobs", "shares", "quota", "config"}
+
+var logLevels = newLogLevels()
+
+func newLogLevels() map[string]*slog.LevelVar {
+	levels := map[string]*slog.LevelVar{}
+	for _, subsystem := range logSubsystems {
+		levels[subsystem] = &slog.LevelVar{}
+	}
+	return levels
+}
+
+var (
+	serverLog    = newLogger("server")
+	httpLog      = newLogger("http")
+	filesLog     = newLogger("files")
+	streamingLog = newLogger("streaming")
+	indexLog     = newLogger("index")
+	trashLog     = newLogger("trash")
+	versionsLog  = newLogger("versions")
+	jobsLog      = newLogger("jobs")
+	sharesLog    = newLogger("shares")
+	quotaLog     = newLogger("quota")
+	configLog    = newLogger("config")
+)
+
+func init() {
+	slog.SetDefault(serverLog)
+	streaming.Log = streamingLog
+	content.Log = indexLog
+}
+
+// logOutput is the handler every logger writes through, which depends on the
+// configured format.
+var logOutputLock = sync.RWMutex{}
+var logOutput slog.Handler = newLogOutput("text")
+var logFormat = "text"
+
+func newLogOutput(format string) slog.Handler {
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if format == "json" {
+		return slog.NewJSONHandler(os.Stdout, options)
+	}
+	return slog.NewTextHandler(os.Stdout, options)
+}
+
+// ConfigureLogging switches the log format and sets every subsystem's level
+// from config.
+func ConfigureLogging(config LoggingConfig) {
+	logOutputLock.Lock()
+	if config.Format != logFormat {
+		logOutput = newLogOutput(config.Format)
+		logFormat = config.Format
+	}
+	logOutputLock.Unlock()
+
+	level := parseLogLevel(config.Level)
+	for subsystem, levelVar := range logLevels {
+		levelVar.Set(level)
+		if subsystemLevel, ok := config.Levels[subsystem]; ok {
+			levelVar.Set(parseLogLevel(subsystemLevel))
+		}
+	}
+}
+
+// parseLogLevel reads a level as slog names them, like "debug" or "warn+2".
+// Levels are validated with the config, so anything else is taken as info.
+func parseLogLevel(s string) slog.Level {
+	level := slog.LevelInfo
+	level.UnmarshalText([]byte(s))
+	return level
+}
+
+func newLogger(subsystem string) *slog.Logger {
+	return slog.New(&logHandler{subsystem: subsystem, level: logLevels[subsystem]})
+}
+
+// logHandler filters records by its subsystem's level, then writes them
+// through whatever logOutput is at the time, tagged with the subsystem and
+// the ID of the request they were logged for.
+type logHandler struct {
+	subsystem string
+	level     *slog.LevelVar
+	with      []func(slog.Handler) slog.Handler // WithAttrs and WithGroup calls, in order
+}
+
+func (h *logHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	logOutputLock.RLock()
+	output := logOutput
+	logOutputLock.RUnlock()
+
+	output = output.WithAttrs([]slog.Attr{slog.String("subsystem", h.subsystem)})
+	if id := requestIDOf(ctx); id != "" {
+		output = output.WithAttrs([]slog.Attr{slog.String("request_id", id)})
+	}
+	for _, with := range h.with {
+		output = with(output)
+	}
+	return output.Handle(ctx, r)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.withHandler(func(output slog.Handler) slog.Handler { return output.WithAttrs(attrs) })
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return h.withHandler(func(output slog.Handler) slog.Handler { return output.WithGroup(name) })
+}
+
+func (h *logHandler) withHandler(with func(slog.Handler) slog.Handler) slog.Handler {
+	return &logHandler{subsystem: h.subsystem, level: h.level, with: append(slices.Clip(h.with), with)}
+}
+
+type requestIDKey struct{}
+
+const requestIDHeader = "X-Request-ID"
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDOf returns the ID of the request ctx belongs to, if it does.
+func requestIDOf(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// statusRecorder remembers the status a response was sent with, for the
+// access log, and the error it reported, if any, for the audit log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	err    error
+}
+
+// responseRecorder finds the statusRecorder w writes through, if there is one.
+func responseRecorder(w http.ResponseWriter) *statusRecorder {
+	for {
+		switch rw := w.(type) {
+		case *statusRecorder:
+			return rw
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// logRequests gives every request handled by h an ID, taken from its
+// X-Request-ID header if a proxy set one, sends it back in the response and
+// logs the request once it has been handled.
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 64 {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := withRequestID(r.Context(), id)
+		recorder := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		h.ServeHTTP(recorder, r.WithContext(ctx))
+		httpLog.InfoContext(ctx, "request", "method", r.Method, "path", r.URL.Path, "status", recorder.status, "duration", time.Since(start), "remote", r.RemoteAddr)
+	})
+}
+
+// logLevelHandler serves and changes the log level of each subsystem, until
+// the config is next reloaded:
+//
+//	GET  /_admin/log
+//	POST /_admin/log?level=<level>                        every subsystem
+//	POST /_admin/log?subsystem=<subsystem>&level=<level>  just the one
+func logLevelHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if r.Method == http.MethodPost {
+			auditAction(r.Context(), auditLogLevels, "", "", r.URL.RawQuery)
+		}
+		adminErr := checkAdmin(w, r, true)
+		if adminErr != nil {
+			writeError(w, adminErr)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			query := r.URL.Query()
+			level := slog.LevelInfo
+			levelErr := level.UnmarshalText([]byte(query.Get("level")))
+			if levelErr != nil {
+				writeError(w, newError(codeBadRequest, "Invalid log level %s", query.Get("level")))
+				return
+			}
+			subsystems := logSubsystems
+			if query.Has("subsystem") {
+				if _, ok := logLevels[query.Get("subsystem")]; !ok {
+					writeError(w, newError(codeBadRequest, "Unknown subsystem %s", query.Get("subsystem")))
+					return
+				}
+				subsystems = []string{query.Get("subsystem")}
+			}
+			for _, subsystem := range subsystems {
+				logLevels[subsystem].Set(level)
+			}
+			configLog.InfoContext(r.Context(), "log levels changed", "subsystems", subsystems, "level", level)
+		default:
+			writeError(w, newError(codeMethodNotAllowed, "Method %s not allowed", r.Method))
+			return
+		}
+
+		levels := map[string]string{}
+		for subsystem, level := range logLevels {
+			levels[subsystem] = level.Level().String()
+		}
+		logOutputLock.RLock()
+		format := logFormat
+		logOutputLock.RUnlock()
+		s, err := json.Marshal(map[string]any{"format": format, "levels": levels})
+		if err != nil {
+			writeError(w, newError(codeInternal, "Error marshalling log levels: %s", err.Error()))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(s)
+	}
+}
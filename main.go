@@ -1,63 +1,43 @@
 package main
 
 import (
-	"errors"
 	"fmt"
-	"log"
 	"os"
-	"strconv"
-
-	"github.com/joho/godotenv"
 )
 
 func main() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
-	}
-
-	portStr, portexists := os.LookupEnv("PORT")
-	if !portexists {
-		log.Fatal("Could not find PORT env var")
-	}
-	port, porterr := strconv.Atoi(portStr)
-	if porterr != nil {
-		log.Fatal("Error converting PORT env var to int", porterr.Error())
-	}
+	// a .env file is optional now that there is a config file, but anything
+	// in it still overrides the config
+	loadDotEnv()
 
-	paths, patherr := getPaths(1, map[string]string{})
-	if patherr != nil {
-		log.Fatal("Error getting path data from env vars", patherr.Error())
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "config" {
+		os.Exit(configCommand(args[1:]))
 	}
 
-	chunkSizeStr, hasChunkSize := os.LookupEnv("CHUNK_SIZE")
-	if !hasChunkSize {
-		chunkSizeStr = "2048"
-	}
-	chunkSize, chunkSizeErr := strconv.Atoi(chunkSizeStr)
-	if chunkSizeErr != nil {
-		log.Fatal("Error converting MAX_FILE_SIZE_MB env var to int", chunkSizeErr.Error())
-	}
-
-	streamablePath, streamablePathExists := os.LookupEnv("STREAMABLE_PATH")
-	if !streamablePathExists {
-		log.Fatal("Error getting streamable path from env vars", patherr.Error())
+	config, err := LoadConfig(args)
+	if err != nil {
+		configLog.Error("error loading config\n" + err.Error())
+		os.Exit(1)
 	}
+	ConfigureLogging(config.Logging)
 
-	fmt.Println("Port:", port, "Paths:", paths)
-	Serve(paths, streamablePath, chunkSize, port)
+	configLog.Info("loaded config", "listen", config.Listen, "roots", config.BasePaths())
+	Serve(config, args)
 }
 
-func getPaths(pathNumber int, paths map[string]string) (map[string]string, error) {
-	varname := fmt.Sprint("PATH_", pathNumber)
-	path, pathexists := os.LookupEnv(varname)
-	if !pathexists {
-		return paths, nil
+// configCommand runs `rnas config validate`, which loads the config as rnas
+// would on startup and prints every problem with it.
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Println("usage: rnas config validate [-config <file>] [flags]")
+		return 2
 	}
-	pathname, pathnameexists := os.LookupEnv(varname + "_NAME")
-	if !pathnameexists {
-		return nil, errors.New(fmt.Sprint("PATH_%d exists but PATH_%d_NAME does not", pathNumber, pathNumber))
+	_, err := LoadConfig(args[1:])
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
 	}
-	paths[pathname] = path
-	return getPaths(pathNumber+1, paths)
+	fmt.Println("config is valid")
+	return 0
 }
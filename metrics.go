@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rnas_http_requests_total",
+		Help: "HTTP requests handled, by method and status code.",
+	}, []string{"method", "code"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rnas_http_request_duration_seconds",
+		Help:    "How long HTTP requests took, by method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "code"})
+	bytesServed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rnas_served_bytes_total",
+		Help: "Bytes of files served, by root.",
+	}, []string{"root"})
+	bytesUploaded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rnas_uploaded_bytes_total",
+		Help: "Bytes of files uploaded, by root.",
+	}, []string{"root"})
+	activeStreams = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rnas_active_streams",
+		Help: "Transcoded videos being streamed right now.",
+	})
+	transcodeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rnas_transcode_duration_seconds",
+		Help:    "How long transcodes took, by outcome.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 14), // up to a little over 2 hours
+	}, []string{"outcome"})
+	transcodeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rnas_transcode_failures_total",
+		Help: "Transcodes that failed, by reason.",
+	}, []string{"reason"})
+	streamCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rnas_stream_cache_requests_total",
+		Help: "Videos requested for streaming, by whether their transcode was already done (hit) or not (miss).",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestDuration, bytesServed, bytesUploaded, activeStreams, transcodeDuration, transcodeFailures, streamCacheRequests)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "rnas_transcodes_queued",
+		Help: "Transcodes waiting for a free slot.",
+	}, func() float64 { return float64(transcodeStore.count(transcodeQueued)) }))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "rnas_transcodes_running",
+		Help: "Transcodes running right now.",
+	}, func() float64 { return float64(transcodeStore.count(transcodeRunning)) }))
+	prometheus.MustRegister(&filesystemCollector{})
+}
+
+// instrumentHandler counts and times every request handled by h.
+func instrumentHandler(h http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerCounter(requestsTotal, promhttp.InstrumentHandlerDuration(requestDuration, h))
+}
+
+// metricsHandler serves the metrics in the Prometheus text format:
+//
+//	GET /metrics
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// rootNameOf returns the name of the root at rootPath, for labelling metrics.
+func rootNameOf(rootPath string) string {
+	for name, path := range getSettings().BasePaths {
+		if path == rootPath {
+			return name
+		}
+	}
+	return ""
+}
+
+// transcodeFailureReason sorts a transcode's error into a few reasons that
+// are worth telling apart on a dashboard.
+func transcodeFailureReason(err error) string {
+	var exitErr *exec.ExitError
+	var numErr *strconv.NumError
+	var pathErr *fs.PathError
+	switch {
+	case errors.As(err, &exitErr):
+		return "ffmpeg_exit"
+	case errors.As(err, &numErr):
+		return "probe"
+	case errors.As(err, &pathErr):
+		return "filesystem"
+	default:
+		return "other"
+	}
+}
+
+// streamCacheSizeInterval is how often the size of the stream cache is
+// measured, as it means walking all of it.
+const streamCacheSizeInterval = time.Minute
+
+// filesystemCollector reports the free space on each root's filesystem and
+// the size of the stream cache. Roots are read when collecting, so they
+// follow config reloads.
+type filesystemCollector struct {
+	lock           sync.Mutex
+	streamCache    string
+	streamSize     int64
+	streamMeasured time.Time
+}
+
+var rootSizeDesc = prometheus.NewDesc("rnas_root_filesystem_size_bytes", "Size of the filesystem each root is on.", []string{"root"}, nil)
+var rootFreeDesc = prometheus.NewDesc("rnas_root_filesystem_free_bytes", "Free space on the filesystem each root is on.", []string{"root"}, nil)
+var rootAvailableDesc = prometheus.NewDesc("rnas_root_filesystem_available_bytes", "Space on the filesystem each root is on that rnas can write to.", []string{"root"}, nil)
+var streamCacheSizeDesc = prometheus.NewDesc("rnas_stream_cache_bytes", "Size of the transcoded videos in the stream cache.", nil, nil)
+
+func (fc *filesystemCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rootSizeDesc
+	ch <- rootFreeDesc
+	ch <- rootAvailableDesc
+	ch <- streamCacheSizeDesc
+}
+
+func (fc *filesystemCollector) Collect(ch chan<- prometheus.Metric) {
+	settings := getSettings()
+	if settings == nil {
+		return
+	}
+	for rootName, rootPath := range settings.BasePaths {
+		report, err := readFilesystem(rootPath)
+		if err != nil {
+			serverLog.Error("error reading filesystem", "root", rootName, "error", err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(rootSizeDesc, prometheus.GaugeValue, float64(report.Size), rootName)
+		ch <- prometheus.MustNewConstMetric(rootFreeDesc, prometheus.GaugeValue, float64(report.Free), rootName)
+		ch <- prometheus.MustNewConstMetric(rootAvailableDesc, prometheus.GaugeValue, float64(report.Available), rootName)
+	}
+
+	if settings.StreamablePath == "" {
+		return
+	}
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	if fc.streamCache != settings.StreamablePath || time.Since(fc.streamMeasured) > streamCacheSizeInterval {
+		fc.streamCache = settings.StreamablePath
+		fc.streamSize = measureTree(settings.StreamablePath).Bytes
+		fc.streamMeasured = time.Now()
+	}
+	ch <- prometheus.MustNewConstMetric(streamCacheSizeDesc, prometheus.GaugeValue, float64(fc.streamSize))
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"os"
+)
+
+func MakeDir(ctx context.Context, fullPath string, parents bool, cErr chan error) {
+	defer close(cErr)
+
+	info, statErr := os.Stat(fullPath)
+	if statErr == nil {
+		if info.IsDir() {
+			cErr <- newError(codeConflict, "Directory %s already exists", clientPath(fullPath))
+		} else {
+			cErr <- newError(codeConflict, "File with name %s already exists", clientPath(fullPath))
+		}
+		return
+	}
+
+	var mkdirErr error
+	if parents {
+		mkdirErr = os.MkdirAll(fullPath, 0777)
+	} else {
+		mkdirErr = os.Mkdir(fullPath, 0777)
+	}
+	if mkdirErr != nil {
+		cErr <- mkdirErr
+		return
+	}
+	notifyChanged(changeCreate, fullPath)
+
+	filesLog.InfoContext(ctx, "made directory", "path", fullPath)
+}
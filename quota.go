@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Quota limits how much can be stored. 0 means no limit.
+type Quota struct {
+	Bytes int64 `json:"bytes"`
+	Files int   `json:"files"`
+}
+
+type QuotaUsage struct {
+	Bytes int64 `json:"bytes"`
+	Files int   `json:"files"`
+}
+
+// QuotaConfig is the quota for each root, by name, and for every user. Users
+// are named by a header set by whatever authenticates requests in front of
+// rnas; without UserHeader there are no per-user quotas.
+type QuotaConfig struct {
+	Roots      map[string]Quota
+	User       Quota
+	UserHeader string
+}
+
+// fileOwner is the user who uploaded a file, and how big it was.
+type fileOwner struct {
+	User string
+	Size int64
+}
+
+// QuotaTracker keeps count of what every root and user is storing. Roots are
+// counted in full, trash and old versions included, since it all takes up
+// disk. Users are charged for the files they uploaded for as long as they
+// exist, in the trash or not. Counts are kept up to date as files are written
+// and removed, and recounted from scratch whenever the roots are rescanned.
+type QuotaTracker struct {
+	lock      sync.Mutex
+	config    QuotaConfig
+	basePaths map[string]string
+	roots     map[string]QuotaUsage
+	users     map[string]QuotaUsage
+	owners    map[string]fileOwner // keyed by real path
+	file      string
+	dirty     bool
+}
+
+var quotas = &QuotaTracker{config: QuotaConfig{Roots: map[string]Quota{}}, basePaths: map[string]string{}, roots: map[string]QuotaUsage{}, users: map[string]QuotaUsage{}, owners: map[string]fileOwner{}}
+
+const ownersFileName = "owners.gob"
+
+// Load reads who owns which files from dataPath, if it was saved before, and
+// starts tracking the roots in basePaths against config.
+func (q *QuotaTracker) Load(basePaths map[string]string, config QuotaConfig, dataPath string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.basePaths = basePaths
+	q.config = config
+	q.file = filepath.Join(dataPath, ownersFileName)
+
+	f, err := os.Open(q.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading file owners: %s", err.Error())
+	}
+	defer f.Close()
+	owners := map[string]fileOwner{}
+	decodeErr := gob.NewDecoder(f).Decode(&owners)
+	if decodeErr != nil {
+		return fmt.Errorf("Error reading file owners: %s", decodeErr.Error())
+	}
+	q.owners = owners
+	return nil
+}
+
+// Configure changes the roots being tracked and their quotas. Counts for new
+// roots only appear when the roots are next recounted.
+func (q *QuotaTracker) Configure(basePaths map[string]string, config QuotaConfig) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.basePaths = basePaths
+	q.config = config
+}
+
+// UserOf returns the user making r, or "" if there are no per-user quotas.
+func (q *QuotaTracker) UserOf(r *http.Request) string {
+	q.lock.Lock()
+	header := q.config.UserHeader
+	q.lock.Unlock()
+	if header == "" {
+		return ""
+	}
+	return r.Header.Get(header)
+}
+
+// Recount walks every root to find what they really hold, and drops owners of
+// files that have gone. The trash's small info files aren't counted.
+func (q *QuotaTracker) Recount() {
+	q.lock.Lock()
+	basePaths := q.basePaths
+	q.lock.Unlock()
+
+	roots := map[string]QuotaUsage{}
+	sizes := map[string]int64{}
+	for rootName, rootPath := range basePaths {
+		usage := QuotaUsage{}
+		infoPath := trashInfoPath(rootPath)
+		filepath.WalkDir(rootPath, func(p string, d fs.DirEntry, err error) error {
+			if err == nil && d.IsDir() && p == infoPath {
+				return filepath.SkipDir
+			}
+			if err != nil || !d.Type().IsRegular() || strings.HasPrefix(d.Name(), uploadTempPrefix) {
+				return nil
+			}
+			if info, infoErr := d.Info(); infoErr == nil {
+				usage.Bytes += info.Size()
+				usage.Files++
+				sizes[p] = info.Size()
+			}
+			return nil
+		})
+		roots[rootName] = usage
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.roots = roots
+	q.users = map[string]QuotaUsage{}
+	for p, owner := range q.owners {
+		size, exists := sizes[p]
+		if !exists {
+			delete(q.owners, p)
+			q.dirty = true
+			continue
+		}
+		owner.Size = size
+		q.owners[p] = owner
+		usage := q.users[owner.User]
+		usage.Bytes += size
+		usage.Files++
+		q.users[owner.User] = usage
+	}
+}
+
+// Check returns a quota error if storing bytes more, in files more files, would
+// take the root at rootPath, or user if there is one, over its quota.
+func (q *QuotaTracker) Check(rootPath string, user string, bytes int64, files int) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	rootName, _, ok := getRootOf(q.basePaths, filepath.Clean(rootPath))
+	if !ok {
+		return nil
+	}
+	if err := checkQuota("/"+rootName, q.config.Roots[rootName], q.roots[rootName], bytes, files); err != nil {
+		return err
+	}
+	if user != "" && q.config.UserHeader != "" {
+		return checkQuota("User "+user, q.config.User, q.users[user], bytes, files)
+	}
+	return nil
+}
+
+func checkQuota(name string, quota Quota, usage QuotaUsage, bytes int64, files int) error {
+	if quota.Bytes > 0 && usage.Bytes+bytes > quota.Bytes {
+		return newError(codeQuotaExceeded, "%s only has %d bytes of its quota left", name, max(quota.Bytes-usage.Bytes, 0))
+	}
+	if quota.Files > 0 && usage.Files+files > quota.Files {
+		return newError(codeQuotaExceeded, "%s only has %d files of its quota left", name, max(quota.Files-usage.Files, 0))
+	}
+	return nil
+}
+
+// Added counts a new file of size bytes written to path by user, which may be
+// empty.
+func (q *QuotaTracker) Added(path string, user string, size int64) {
+	q.charge(path, user, size, size, 1)
+}
+
+// Replaced counts a file of size bytes written to path by user over one of
+// oldSize bytes, whose owner stops being charged for it. The old contents are
+// counted again where they are kept as a version, by saveVersion, just as a
+// recount would find them.
+func (q *QuotaTracker) Replaced(path string, user string, size int64, oldSize int64) {
+	q.charge(path, user, size, size-oldSize, 0)
+}
+
+func (q *QuotaTracker) charge(path string, user string, size int64, rootBytes int64, rootFiles int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	rootName, _, ok := getRootOf(q.basePaths, path)
+	if !ok {
+		return
+	}
+	q.roots[rootName] = addQuotaUsage(q.roots[rootName], rootBytes, rootFiles)
+	if old, owned := q.owners[path]; owned {
+		q.users[old.User] = addQuotaUsage(q.users[old.User], -old.Size, -1)
+		delete(q.owners, path)
+		q.dirty = true
+	}
+	if user != "" {
+		q.owners[path] = fileOwner{User: user, Size: size}
+		q.users[user] = addQuotaUsage(q.users[user], size, 1)
+		q.dirty = true
+	}
+}
+
+// Removed uncounts the file at path, of size bytes, once it has been deleted.
+func (q *QuotaTracker) Removed(path string, size int64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	rootName, _, ok := getRootOf(q.basePaths, path)
+	if !ok {
+		return
+	}
+	q.roots[rootName] = addQuotaUsage(q.roots[rootName], -size, -1)
+	if owner, owned := q.owners[path]; owned {
+		q.users[owner.User] = addQuotaUsage(q.users[owner.User], -owner.Size, -1)
+		delete(q.owners, path)
+		q.dirty = true
+	}
+}
+
+// RemovedTree uncounts everything that was below path, once it has all been
+// deleted, given the totals measured beforehand.
+func (q *QuotaTracker) RemovedTree(path string, usage QuotaUsage) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	rootName, _, ok := getRootOf(q.basePaths, path)
+	if !ok {
+		return
+	}
+	q.roots[rootName] = addQuotaUsage(q.roots[rootName], -usage.Bytes, -usage.Files)
+	prefix := path + string(filepath.Separator)
+	for p, owner := range q.owners {
+		if p == path || strings.HasPrefix(p, prefix) {
+			q.users[owner.User] = addQuotaUsage(q.users[owner.User], -owner.Size, -1)
+			delete(q.owners, p)
+			q.dirty = true
+		}
+	}
+}
+
+// Moved keeps the owners of files moved from oldPath to newPath, which must be
+// in the same root.
+func (q *QuotaTracker) Moved(oldPath string, newPath string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	prefix := oldPath + string(filepath.Separator)
+	moved := map[string]fileOwner{}
+	for p, owner := range q.owners {
+		if p == oldPath || strings.HasPrefix(p, prefix) {
+			delete(q.owners, p)
+			moved[newPath+strings.TrimPrefix(p, oldPath)] = owner
+		}
+	}
+	for p, owner := range moved {
+		q.owners[p] = owner
+		q.dirty = true
+	}
+}
+
+func addQuotaUsage(usage QuotaUsage, bytes int64, files int) QuotaUsage {
+	usage.Bytes = max(usage.Bytes+bytes, 0)
+	usage.Files = max(usage.Files+files, 0)
+	return usage
+}
+
+// measureTree totals the regular files at or below path.
+func measureTree(path string) QuotaUsage {
+	usage := QuotaUsage{}
+	filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, infoErr := d.Info(); infoErr == nil {
+			usage.Bytes += info.Size()
+			usage.Files++
+		}
+		return nil
+	})
+	return usage
+}
+
+// Save writes the file owners to disk if they have changed since they were
+// last saved.
+func (q *QuotaTracker) Save() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.dirty || q.file == "" {
+		return
+	}
+	mkdirErr := os.MkdirAll(filepath.Dir(q.file), 0777)
+	if mkdirErr != nil {
+		quotaLog.Error("error saving file owners", "error", mkdirErr)
+		return
+	}
+	tmp := q.file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		quotaLog.Error("error saving file owners", "error", err)
+		return
+	}
+	encodeErr := gob.NewEncoder(f).Encode(q.owners)
+	closeErr := f.Close()
+	if encodeErr != nil || closeErr != nil {
+		quotaLog.Error("error saving file owners", "error", errors.Join(encodeErr, closeErr))
+		os.Remove(tmp)
+		return
+	}
+	renameErr := os.Rename(tmp, q.file)
+	if renameErr != nil {
+		quotaLog.Error("error saving file owners", "error", renameErr)
+		return
+	}
+	q.dirty = false
+}
+
+type RootQuotaReport struct {
+	Name       string           `json:"name"`
+	Used       QuotaUsage       `json:"used"`
+	Limit      Quota            `json:"limit"`
+	Filesystem FilesystemReport `json:"filesystem"`
+}
+
+// FilesystemReport is what statfs says about the filesystem a root is on.
+// Available is what can actually be written, which leaves out blocks reserved
+// for root.
+type FilesystemReport struct {
+	Size      int64 `json:"size"`
+	Free      int64 `json:"free"`
+	Available int64 `json:"available"`
+}
+
+type UserQuotaReport struct {
+	Name  string     `json:"name"`
+	Used  QuotaUsage `json:"used"`
+	Limit Quota      `json:"limit"`
+}
+
+type QuotaReport struct {
+	Roots []RootQuotaReport `json:"roots"`
+	User  *UserQuotaReport  `json:"user,omitempty"`
+}
+
+// readFilesystem reports the size and free space of the filesystem path is on.
+func readFilesystem(path string) (FilesystemReport, error) {
+	stat := syscall.Statfs_t{}
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return FilesystemReport{}, err
+	}
+	return FilesystemReport{Size: int64(stat.Blocks) * int64(stat.Bsize), Free: int64(stat.Bfree) * int64(stat.Bsize), Available: int64(stat.Bavail) * int64(stat.Bsize)}, nil
+}
+
+// ReadQuotas sends the usage and limits of every root, and of user if there
+// is one, as JSON.
+func ReadQuotas(user string, c chan<- string, cErr chan<- error) {
+	defer close(cErr)
+	defer close(c)
+
+	report := QuotaReport{Roots: []RootQuotaReport{}}
+	quotas.lock.Lock()
+	for rootName := range quotas.basePaths {
+		report.Roots = append(report.Roots, RootQuotaReport{Name: rootName, Used: quotas.roots[rootName], Limit: quotas.config.Roots[rootName]})
+	}
+	if user != "" && quotas.config.UserHeader != "" {
+		report.User = &UserQuotaReport{Name: user, Used: quotas.users[user], Limit: quotas.config.User}
+	}
+	basePaths := quotas.basePaths
+	quotas.lock.Unlock()
+
+	for i, root := range report.Roots {
+		filesystem, statErr := readFilesystem(basePaths[root.Name])
+		if statErr != nil {
+			cErr <- fmt.Errorf("Error reading filesystem of %s: %s", root.Name, statErr.Error())
+			return
+		}
+		report.Roots[i].Filesystem = filesystem
+	}
+	slices.SortFunc(report.Roots, func(a, b RootQuotaReport) int { return strings.Compare(a.Name, b.Name) })
+
+	s, err := json.Marshal(report)
+	if err != nil {
+		cErr <- fmt.Errorf("Error marshalling quotas: %s", err.Error())
+		return
+	}
+	c <- string(s)
+}
@@ -1,17 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"rnas/streaming"
 	"strings"
-	"sync"
 
 	"github.com/gabriel-vasile/mimetype"
 )
 
-func Read(path string, basePaths map[string]string, virtualPath string, streamablePath string, cErr chan<- error, cDir chan<- string, cFile chan<- []byte, chunkSize int) {
+func Read(ctx context.Context, path string, basePaths map[string]string, virtualPath string, streamablePath string, listOptions ListOptions, cErr chan<- error, cDir chan<- string, cFile chan<- []byte, chunkSize int) {
 	defer close(cErr)
 
 	if path == "" {
@@ -23,17 +26,29 @@ func Read(path string, basePaths map[string]string, virtualPath string, streamab
 		return
 	}
 
-	fileName, _, virtualPathPrefix := streaming.GetStreamStrings(virtualPath)
-	streamDir, streamDirErr := streaming.GetStreamablePath(fileName, virtualPathPrefix, streamablePath)
-	if streamDirErr != nil {
-		cErr <- fmt.Errorf("Error reading file or directory: %s", streamDirErr.Error())
+	if archivePath, member, ok := splitArchivePath(path, listOptions.Browse); ok {
+		archiveErr := readArchive(archivePath, member, virtualPath, cDir, cFile, chunkSize)
+		if archiveErr != nil {
+			cErr <- archiveErr
+		}
 		return
 	}
+
+	fileName, _, virtualPathPrefix := streaming.GetStreamStrings(virtualPath)
+	var streamDir *string
+	if streamablePath != "" {
+		var streamDirErr error
+		streamDir, streamDirErr = streaming.GetStreamablePath(ctx, fileName, virtualPathPrefix, streamablePath)
+		if streamDirErr != nil {
+			cErr <- fmt.Errorf("Error reading file or directory: %s", streamDirErr.Error())
+			return
+		}
+	}
 	if streamDir != nil {
 		close(cDir)
-		fmt.Println("is streaming file!", path, virtualPath)
+		filesLog.DebugContext(ctx, "reading from the stream cache", "path", virtualPath, "dir", *streamDir)
 		streamFilePath := fmt.Sprintf("%s/%s", *streamDir, fileName)
-		fileErr := readFile(streamFilePath, virtualPath, streamablePath, cFile, chunkSize)
+		fileErr := readFile(ctx, streamFilePath, virtualPath, streamablePath, cFile, chunkSize)
 		if fileErr != nil {
 			cErr <- fileErr
 		}
@@ -42,19 +57,24 @@ func Read(path string, basePaths map[string]string, virtualPath string, streamab
 
 	info, fsErr := os.Stat(path)
 	if fsErr != nil {
-		cErr <- fmt.Errorf("Error reading file or directory: %s", fsErr.Error())
+		cErr <- fmt.Errorf("Error reading file or directory: %w", fsErr)
 		return
 	}
 	if info.IsDir() {
 		close(cFile)
-		dirErr := readDir(path, cDir)
+		var dirErr error
+		if listOptions.NDJSON {
+			dirErr = readDirNDJSON(path, cDir, listOptions)
+		} else {
+			dirErr = readDir(path, cDir, listOptions)
+		}
 		if dirErr != nil {
 			cErr <- dirErr
 		}
 		return
 	}
 	close(cDir)
-	fileErr := readFile(path, virtualPath, streamablePath, cFile, chunkSize)
+	fileErr := readFile(ctx, path, virtualPath, streamablePath, cFile, chunkSize)
 	if fileErr != nil {
 		cErr <- fileErr
 	}
@@ -62,9 +82,10 @@ func Read(path string, basePaths map[string]string, virtualPath string, streamab
 }
 
 type DirInfo struct {
-	Type  string `json:"type"` // should always be "directory"
-	Name  string `json:"name"`
-	Count int    `json:"count"`
+	Type     string            `json:"type"` // should always be "directory"
+	Name     string            `json:"name"`
+	Count    int               `json:"count"`
+	Children []json.RawMessage `json:"children,omitempty"` // only in recursive listings
 }
 type FileInfo struct {
 	Type     string `json:"type"` // should always be "file"
@@ -72,19 +93,26 @@ type FileInfo struct {
 	Name     string `json:"name"`
 	Size     int    `json:"size"`
 	Modified int    `json:"modified"`
+	ETag     string `json:"etag"`
 }
 
-func readFile(path string, virtualPath string, streamablePath string, c chan<- []byte, chunkSize int) error {
+// getETag identifies a version of a file by its modification time and size,
+// which is enough to spot a file having been replaced since it was read.
+func getETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+func readFile(ctx context.Context, path string, virtualPath string, streamablePath string, c chan<- []byte, chunkSize int) error {
 	defer close(c)
 
 	file, err := os.Open(path)
 	if err != nil {
-		return fmt.Errorf("Error reading file: %s", err.Error())
+		return fmt.Errorf("Error reading file: %w", err)
 	}
 
 	fileInfo, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("Error reading file: %s", err.Error())
+		return fmt.Errorf("Error reading file: %w", err)
 	}
 
 	mime, mimeErr := mimetype.DetectFile(path)
@@ -92,19 +120,28 @@ func readFile(path string, virtualPath string, streamablePath string, c chan<- [
 		return mimeErr
 	}
 
-	if strings.HasPrefix(mime.String(), "video/") {
-		fmt.Println(fmt.Sprintf("this is a video: %v (%s)", mime.String(), path))
-		file, fileInfo, err = getStreamFile(path, virtualPath, streamablePath)
+	// without a streamable path, videos are sent as they are
+	if streamablePath != "" && strings.HasPrefix(mime.String(), "video/") {
+		filesLog.DebugContext(ctx, "streaming video", "path", path, "mime", mime.String())
+		file, fileInfo, err = getStreamFile(ctx, path, virtualPath, streamablePath)
 		if err != nil {
-			return fmt.Errorf("Error reading streaming file: %s", err.Error())
+			return newError(codeTranscodeFailed, "Error reading streaming file: %w", err)
 		}
 	}
 	defer file.Close()
 
-	for offset := int64(0); offset < fileInfo.Size(); offset += int64(chunkSize) {
-		realChunkSize := min(chunkSize, int(fileInfo.Size()-offset))
+	if streamablePath != "" && (strings.HasPrefix(path, streamablePath) || strings.HasPrefix(mime.String(), "video/")) {
+		activeStreams.Inc()
+		defer activeStreams.Dec()
+	}
+	return sendFileChunks(file, fileInfo.Size(), c, chunkSize)
+}
+
+func sendFileChunks(file *os.File, size int64, c chan<- []byte, chunkSize int) error {
+	for offset := int64(0); offset < size; offset += int64(chunkSize) {
+		realChunkSize := min(chunkSize, int(size-offset))
 		fileBytes := make([]byte, realChunkSize)
-		_, err = file.ReadAt(fileBytes, offset)
+		_, err := file.ReadAt(fileBytes, offset)
 		if err != nil {
 			return fmt.Errorf("Error reading file: %s", err.Error())
 		}
@@ -114,69 +151,141 @@ func readFile(path string, virtualPath string, streamablePath string, c chan<- [
 	return nil
 }
 
-func readDir(path string, c chan<- string) error {
+func readDir(path string, c chan<- string, opts ListOptions) error {
 	defer close(c)
 
 	dir, err := os.Open(path)
 	if err != nil {
-		return fmt.Errorf("Error reading directory: %s", err.Error())
+		return fmt.Errorf("Error reading directory: %w", err)
 	}
 	defer dir.Close()
 
-	files, err := dir.Readdir(0)
+	allFiles, err := dir.Readdir(0)
 	if err != nil {
-		return fmt.Errorf("Error reading directory: %s", err.Error())
+		return fmt.Errorf("Error reading directory: %w", err)
+	}
+	files := []os.FileInfo{}
+	for _, file := range allFiles {
+		if !isHiddenEntry(file.Name()) {
+			files = append(files, file)
+		}
 	}
+	entries, next := getListPage(path, files, opts)
 
-	if len(files) == 0 {
+	if opts.Paged() {
+		c <- `{"items":`
+	}
+	if len(entries) == 0 {
 		c <- "[]"
-		return nil
 	}
 
-	for idx, file := range files {
+	for idx, entry := range entries {
 		if idx == 0 {
 			c <- "["
 		}
 
-		if file.IsDir() {
-			separator := "/"
-			if strings.HasSuffix(path, "/") {
-				separator = ""
-			}
-			subPath := path + separator + file.Name()
-			dirInfo, dirErr := getDirInfo(file.Name(), subPath)
-			if dirErr != nil {
-				return dirErr
+		s, err := getListEntryJSON(entry, opts)
+		if err != nil {
+			return err
+		}
+		c <- string(s)
+
+		if idx == len(entries)-1 {
+			c <- "]"
+		} else {
+			c <- ","
+		}
+	}
+
+	if opts.Paged() {
+		s, err := json.Marshal(next)
+		if err != nil {
+			return fmt.Errorf("Error marshalling next cursor: %s", err.Error())
+		}
+		c <- `,"next":` + string(s) + "}"
+	}
+	return nil
+}
+
+// readDirNDJSON sends each entry of the directory at path as its own line as
+// soon as it has been read, finishing with a ListSummary line. Entries that
+// can't be read are reported in the summary instead of ending the listing.
+// Sorted or paged listings still have to read the whole directory first.
+func readDirNDJSON(path string, c chan<- string, opts ListOptions) error {
+	defer close(c)
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Error reading directory: %w", err)
+	}
+	defer dir.Close()
+
+	summary := ListSummary{Type: "summary", Errors: []ListError{}}
+	sendEntry := func(entry listEntry) {
+		s, err := getListEntryJSON(entry, opts)
+		if err != nil {
+			summary.Errors = append(summary.Errors, ListError{Name: entry.info.Name(), Error: err.Error()})
+			return
+		}
+		c <- string(s) + "\n"
+		summary.Count++
+		if !entry.info.IsDir() {
+			summary.Size += int(entry.info.Size())
+		}
+	}
+
+	files := []os.FileInfo{}
+	for {
+		batch, batchErr := dir.ReadDir(256)
+		for _, dirEntry := range batch {
+			if isHiddenEntry(dirEntry.Name()) {
+				continue
 			}
-			s, err := json.Marshal(dirInfo)
-			if err != nil {
-				return fmt.Errorf("Error marshalling directory info: %s", err.Error())
+			file, infoErr := dirEntry.Info()
+			if infoErr != nil {
+				summary.Errors = append(summary.Errors, ListError{Name: dirEntry.Name(), Error: infoErr.Error()})
+				continue
 			}
-			c <- string(s)
-		} else { // if file
-			mime, mimeErr := mimetype.DetectFile(fmt.Sprintf("%v/%v", path, file.Name()))
-			if mimeErr != nil {
-				return mimeErr
+			if opts.Ordered() {
+				files = append(files, file)
+				continue
 			}
-			s, err := json.Marshal(FileInfo{Type: "file", MimeType: mime.String(), Name: file.Name(), Size: int(file.Size()), Modified: int(file.ModTime().Unix())})
-			if err != nil {
-				return fmt.Errorf("Error marshalling file info: %s", err.Error())
+			if entry, ok := getListEntry(path, file, opts); ok {
+				sendEntry(entry)
 			}
-			c <- string(s)
 		}
+		if errors.Is(batchErr, io.EOF) {
+			break
+		}
+		if batchErr != nil {
+			summary.Errors = append(summary.Errors, ListError{Name: filepath.Base(path), Error: batchErr.Error()})
+			break
+		}
+	}
 
-		if idx == len(files)-1 {
-			c <- "]"
-		} else {
-			c <- ","
+	if opts.Ordered() {
+		entries, next := getListPage(path, files, opts)
+		for _, entry := range entries {
+			sendEntry(entry)
 		}
+		summary.Next = next
+	}
+
+	s, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("Error marshalling listing summary: %s", err.Error())
 	}
+	c <- string(s) + "\n"
 	return nil
 }
 
 func readBase(basePaths map[string]string, c chan<- string) error {
 	defer close(c)
 
+	if len(basePaths) == 0 {
+		c <- "[]"
+		return nil
+	}
 	idx := 0
 	for name, path := range basePaths {
 		if idx == 0 {
@@ -188,10 +297,9 @@ func readBase(basePaths map[string]string, c chan<- string) error {
 		}
 		s, err := json.Marshal(dirInfo)
 		if err != nil {
-			fmt.Println(fmt.Errorf("Error marshalling directory info: %s", err.Error()))
+			filesLog.Error("error marshalling directory info", "error", err)
 			continue
 		}
-		fmt.Println("dir", s)
 		c <- string(s)
 
 		if idx == len(basePaths)-1 {
@@ -207,88 +315,18 @@ func readBase(basePaths map[string]string, c chan<- string) error {
 func getDirInfo(name string, path string) (*DirInfo, error) {
 	dir, err := os.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("Error reading directory %s: %s", path, err.Error())
+		return nil, fmt.Errorf("Error reading directory %s: %w", path, err)
 	}
 	defer dir.Close()
 	subFiles, err := dir.Readdir(0)
 	if err != nil {
-		return nil, fmt.Errorf("Error getting files from directory %s: %s", path, err.Error())
-	}
-	return &DirInfo{Type: "directory", Name: name, Count: len(subFiles)}, nil
-}
-
-var ffmpegRunsLock = sync.RWMutex{}
-var ffmpegRuns = map[string]bool{}
-
-func getStreamFile(path string, virtualPath string, streamablePath string) (*os.File, os.FileInfo, error) {
-	parts := strings.Split(virtualPath, "/")
-	fileName := parts[len(parts)-1]
-	if fileName == "" {
-		return nil, nil, fmt.Errorf("filename could not be found at virtual path %s", virtualPath)
+		return nil, fmt.Errorf("Error getting files from directory %s: %w", path, err)
 	}
-	sanitisedFileName := strings.ReplaceAll(fileName, ".", "-")
-	outputPath := fmt.Sprintf("%s%s/", streamablePath, strings.Join(parts[:len(parts)-1], "/"))
-	outputFileName := fmt.Sprintf("%s.%s", sanitisedFileName, "m3u8")
-	outputFilePath := fmt.Sprintf("%s%s", outputPath, outputFileName)
-	ffmpegRunsLock.Lock()
-	dir, err := os.ReadDir(outputPath)
-	if err != nil {
-		fmt.Println("not found, creating dir", outputPath)
-		mkdirErr := os.MkdirAll(outputPath, 0777)
-		if mkdirErr != nil {
-			return nil, nil, mkdirErr
-		}
-	}
-	fmt.Println("trying to open file, ", outputFilePath, "in", outputPath, " - ", len(dir), "files")
-	file, err := os.Open(outputFilePath)
-	isLoadingFile, hasLoadedFile := ffmpegRuns[outputFilePath]
-	fileLoading := isLoadingFile && hasLoadedFile
-	for _, subdir := range dir {
-		fmt.Println("looking at", subdir.Name(), "for", sanitisedFileName)
-		if strings.HasPrefix(subdir.Name(), sanitisedFileName) {
-			fmt.Println("found loading file")
-			fileLoading = true
-			break
-		}
-	}
-	if err != nil && !fileLoading {
-		ffmpegRuns[outputFilePath] = true
-		ffmpegErr := streaming.RunFfmpeg(sanitisedFileName, path, outputPath)
-		if ffmpegErr != nil {
-			delete(ffmpegRuns, outputFilePath)
-			return nil, nil, ffmpegErr
+	count := 0
+	for _, subFile := range subFiles {
+		if !isHiddenEntry(subFile.Name()) {
+			count++
 		}
 	}
-	for {
-		isLoadingFile, hasLoadedFile = ffmpegRuns[outputFilePath]
-		fileLoading = isLoadingFile && hasLoadedFile
-		if !fileLoading {
-			break
-		}
-		dir, err = os.ReadDir(outputPath)
-		if err != nil {
-			return nil, nil, err
-		}
-		for _, subdir := range dir {
-			if !fileLoading {
-				break
-			}
-			if strings.HasPrefix(subdir.Name(), sanitisedFileName) {
-				fileLoading = true
-			}
-			if subdir.Name() == outputFileName {
-				ffmpegRuns[outputFilePath] = false
-			}
-		}
-	}
-	ffmpegRunsLock.Unlock()
-	file, err = os.Open(outputFilePath)
-	if err != nil {
-		return nil, nil, err
-	}
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return nil, nil, err
-	}
-	return file, fileInfo, nil
+	return &DirInfo{Type: "directory", Name: name, Count: count}, nil
 }
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/netip"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"rnas/streaming"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Settings is everything requests need from the config. A request reads it
+// once when it starts, so it carries on with the settings it started with
+// even if the config is reloaded part way through.
+type Settings struct {
+	Config           Config
+	BasePaths        map[string]string
+	RootOptions      map[string]RootOptions
+	StreamablePath   string
+	ChunkSize        int
+	TrashRetention   time.Duration
+	VersionRetention VersionRetention
+	TrustedProxies   []netip.Prefix
+}
+
+func newSettings(config Config) *Settings {
+	return &Settings{
+		Config:           config,
+		BasePaths:        config.BasePaths(),
+		RootOptions:      config.RootOptions(),
+		StreamablePath:   config.Streaming.Path,
+		ChunkSize:        config.ChunkSize,
+		TrashRetention:   time.Duration(config.Trash.RetentionDays) * 24 * time.Hour,
+		VersionRetention: config.VersionRetention(),
+		TrustedProxies:   config.TrustedProxies(),
+	}
+}
+
+var currentSettings = atomic.Pointer[Settings]{}
+
+func getSettings() *Settings {
+	return currentSettings.Load()
+}
+
+// processEnv is the env vars rnas was started with, which .env never
+// overrides. dotEnv is what was last read from .env.
+var processEnv = map[string]bool{}
+var dotEnv = map[string]string{}
+
+// loadDotEnv sets the env vars in .env, if there is one, apart from any set
+// when rnas was started. Vars that have been taken out of .env since it was
+// last read are unset.
+func loadDotEnv() {
+	if len(processEnv) == 0 {
+		for _, kv := range os.Environ() {
+			name, _, _ := strings.Cut(kv, "=")
+			processEnv[name] = true
+		}
+	}
+	values, err := godotenv.Read()
+	if err != nil {
+		values = map[string]string{}
+	}
+	for name := range dotEnv {
+		if _, kept := values[name]; !kept && !processEnv[name] {
+			os.Unsetenv(name)
+		}
+	}
+	for name, value := range values {
+		if !processEnv[name] {
+			os.Setenv(name, value)
+		}
+	}
+	dotEnv = values
+}
+
+// applySettings configures everything that runs outside of requests to
+// match settings.
+func applySettings(settings *Settings) {
+	ConfigureLogging(settings.Config.Logging)
+	streaming.Configure(settings.Config.StreamingOutputs())
+	setCacheLimits(settings.Config.Cache)
+	auditLog.Configure(settings.Config.Audit)
+	quotas.Configure(settings.BasePaths, settings.Config.QuotaConfig())
+	fileIndex.SetRoots(settings.BasePaths)
+	changeFeed.SetRoots(settings.BasePaths)
+	setWatchedRoots(settings.BasePaths)
+}
+
+func setCacheLimits(cache CacheConfig) {
+	mimeCacheLock.Lock()
+	mimeCacheMaxEntries = cache.MimeTypes
+	mimeCacheLock.Unlock()
+	archiveIndexCacheLock.Lock()
+	archiveIndexMaxEntries = cache.ArchiveIndexes
+	archiveIndexCacheLock.Unlock()
+	changeFeed.lock.Lock()
+	changeFeedBacklog = cache.ChangeFeedBacklog
+	changeFeed.lock.Unlock()
+	jobsLock.Lock()
+	maxFinishedJobs = cache.FinishedJobs
+	jobsLock.Unlock()
+}
+
+// restartOnlySettings can't change while rnas is running, so changes to them
+// are logged but only take effect after a restart. Until then the running
+// values are kept. Settings in a section are named by their path, like
+// streaming.path, which the transcode store only reads on startup.
+var restartOnlySettings = []string{"listen", "data_path", "rescan_interval_minutes", "streaming.path"}
+
+// secretSettings are never written out when describing what changed.
+var secretSettings = []string{"auth.admin_token"}
+
+var reloadLock = sync.Mutex{}
+
+// Reload reads the config again, the same way it was read at startup with
+// args, and switches to it. If the new config is invalid, nothing changes.
+// It returns what changed.
+func Reload(args []string) ([]string, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	loadDotEnv()
+	config, err := LoadConfig(args)
+	if err != nil {
+		return nil, err
+	}
+	old := getSettings()
+	changes := diffConfig(old.Config, config)
+	if len(changes) == 0 {
+		return changes, nil
+	}
+	for _, name := range restartOnlySettings {
+		running, updated := getConfigField(&old.Config, name), getConfigField(&config, name)
+		if running.IsValid() && !reflect.DeepEqual(running.Interface(), updated.Interface()) {
+			configLog.Warn("changes take effect after a restart", "setting", name)
+			updated.Set(running)
+		}
+	}
+
+	settings := newSettings(config)
+	currentSettings.Store(settings)
+	applySettings(settings)
+	if !maps.Equal(old.BasePaths, settings.BasePaths) {
+		go rescanRoots()
+	}
+	return changes, nil
+}
+
+// getConfigField returns the config's field with the given yaml name, which
+// names a field in a section by its path, like streaming.path. It is the zero
+// Value if there is no such field.
+func getConfigField(config *Config, name string) reflect.Value {
+	field := reflect.ValueOf(config).Elem()
+	for _, part := range strings.Split(name, ".") {
+		field = field.FieldByNameFunc(func(fieldName string) bool {
+			f, _ := field.Type().FieldByName(fieldName)
+			return strings.Split(f.Tag.Get("yaml"), ",")[0] == part
+		})
+		if !field.IsValid() {
+			return field
+		}
+	}
+	return field
+}
+
+// diffConfig describes every setting that differs between old and updated, one
+// per line. Roots are matched up by name.
+func diffConfig(old Config, updated Config) []string {
+	changes := []string{}
+	oldRoots := map[string]RootConfig{}
+	for _, root := range old.Roots {
+		oldRoots[root.Name] = root
+	}
+	newRoots := map[string]RootConfig{}
+	for _, root := range updated.Roots {
+		newRoots[root.Name] = root
+	}
+	for _, name := range slices.Sorted(maps.Keys(oldRoots)) {
+		if _, kept := newRoots[name]; !kept {
+			changes = append(changes, fmt.Sprintf("roots: removed %s (%s)", name, oldRoots[name].Path))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(newRoots)) {
+		oldRoot, existed := oldRoots[name]
+		if !existed {
+			changes = append(changes, fmt.Sprintf("roots: added %s (%s)", name, newRoots[name].Path))
+			continue
+		}
+		changes = append(changes, diffValues("roots."+name, oldRoot, newRoots[name])...)
+	}
+
+	old.Roots, updated.Roots = nil, nil
+	return append(diffValues("", old, updated), changes...)
+}
+
+// diffValues compares old and updated as they would be written in the config
+// file, returning a line for every value that differs under prefix.
+func diffValues(prefix string, old any, updated any) []string {
+	oldValues := map[string]string{}
+	flattenConfigValue(prefix, toYAMLValue(old), oldValues)
+	newValues := map[string]string{}
+	flattenConfigValue(prefix, toYAMLValue(updated), newValues)
+
+	keys := map[string]bool{}
+	for key := range oldValues {
+		keys[key] = true
+	}
+	for key := range newValues {
+		keys[key] = true
+	}
+	changes := []string{}
+	for _, key := range slices.Sorted(maps.Keys(keys)) {
+		oldValue, hadOld := oldValues[key]
+		newValue, hasNew := newValues[key]
+		if slices.Contains(secretSettings, key) && oldValue != newValue {
+			changes = append(changes, key+": changed")
+			continue
+		}
+		switch {
+		case !hadOld:
+			changes = append(changes, fmt.Sprintf("%s: set to %s", key, newValue))
+		case !hasNew:
+			changes = append(changes, fmt.Sprintf("%s: unset, was %s", key, oldValue))
+		case oldValue != newValue:
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", key, oldValue, newValue))
+		}
+	}
+	return changes
+}
+
+// toYAMLValue turns v into the maps, lists and scalars it would be written
+// as in YAML.
+func toYAMLValue(v any) any {
+	s, err := yaml.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var value any
+	yaml.Unmarshal(s, &value)
+	return value
+}
+
+func flattenConfigValue(prefix string, value any, values map[string]string) {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, child := range v {
+			flattenConfigValue(strings.TrimPrefix(prefix+"."+key, "."), child, values)
+		}
+	case []any:
+		for i, child := range v {
+			flattenConfigValue(fmt.Sprintf("%s[%d]", prefix, i), child, values)
+		}
+	case nil:
+	default:
+		values[prefix] = fmt.Sprint(v)
+	}
+}
+
+// ReloadOnSignal runs forever, reloading the config with args whenever rnas
+// is sent SIGHUP. Each reload is audited, as no request records it.
+func ReloadOnSignal(args []string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		changes, err := Reload(args)
+		logReload(changes, err)
+		entry := AuditEntry{Time: int(time.Now().Unix()), Action: auditConfigReload, Outcome: auditOK, Detail: "SIGHUP"}
+		if err != nil {
+			entry.Outcome, entry.Error = auditError, err.Error()
+		} else if len(changes) > 0 {
+			entry.Detail += ": " + strings.Join(changes, "; ")
+		}
+		auditLog.Append(entry)
+	}
+}
+
+func logReload(changes []string, err error) {
+	if err != nil {
+		configLog.Error("error reloading config, keeping the running config\n" + err.Error())
+		return
+	}
+	configLog.Info("config reloaded", "changes", changes)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDiffConfig(t *testing.T) {
+	base := func() Config {
+		config := defaultConfig()
+		config.Roots = []RootConfig{{Name: "files", Path: "/srv/files"}, {Name: "media", Path: "/srv/media"}}
+		return config
+	}
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   []string
+	}{
+		{"unchanged", func(c *Config) {}, []string{}},
+		{"setting", func(c *Config) { c.ChunkSize = 4096 }, []string{"chunk_size: 2048 -> 4096"}},
+		{"section", func(c *Config) { c.Trash.RetentionDays = 7 }, []string{"trash.retention_days: 30 -> 7"}},
+		{"list", func(c *Config) { c.Listen[0].Address = ":8080" }, []string{"listen[0].address: :6969 -> :8080"}},
+		{"secret", func(c *Config) { c.Auth.AdminToken = "0123456789abcdef" }, []string{"auth.admin_token: changed"}},
+		{"root added", func(c *Config) { c.Roots = append(c.Roots, RootConfig{Name: "more", Path: "/srv/more"}) }, []string{"roots: added more (/srv/more)"}},
+		{"root removed", func(c *Config) { c.Roots = c.Roots[:1] }, []string{"roots: removed media (/srv/media)"}},
+		{"roots reordered", func(c *Config) { c.Roots[0], c.Roots[1] = c.Roots[1], c.Roots[0] }, []string{}},
+		{"root changed", func(c *Config) { c.Roots[1].Path, c.Roots[1].ReadOnly = "/mnt/media", true }, []string{"roots.media.path: /srv/media -> /mnt/media", "roots.media.read_only: false -> true"}},
+		{"root renamed", func(c *Config) { c.Roots[1].Name = "videos" }, []string{"roots: removed media (/srv/media)", "roots: added videos (/srv/media)"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updated := base()
+			tt.change(&updated)
+			if got := diffConfig(base(), updated); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetConfigField(t *testing.T) {
+	config := defaultConfig()
+	config.Streaming.Path = "/srv/streaming"
+	tests := []struct {
+		name string
+		want any
+	}{
+		{"data_path", config.DataPath},
+		{"rescan_interval_minutes", config.RescanIntervalMinutes},
+		{"streaming.path", "/srv/streaming"},
+		{"streaming.crf", config.Streaming.CRF},
+		{"missing", nil},
+		{"streaming.missing", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			field := getConfigField(&config, tt.name)
+			if tt.want == nil {
+				if field.IsValid() {
+					t.Errorf("got %v, want no field", field.Interface())
+				}
+				return
+			}
+			if !field.IsValid() || field.Interface() != tt.want {
+				t.Errorf("got %v, want %v", field, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"cmp"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type IndexEntry struct {
+	Root     string `json:"root"`
+	Path     string `json:"path"` // virtual path
+	Type     string `json:"type"` // "file" or "directory"
+	Name     string `json:"name"`
+	MimeType string `json:"mime,omitempty"`
+	Size     int    `json:"size"`
+	Modified int    `json:"modified"`
+}
+
+// FileIndex holds an entry for every file and directory in every root, keyed
+// by real path. It is saved to disk so a restart can answer searches while the
+// roots are walked again.
+type FileIndex struct {
+	lock      sync.RWMutex
+	entries   map[string]IndexEntry
+	basePaths map[string]string
+	file      string
+	dirty     bool
+	// rebuilt holds the paths updated while a rebuild is walking the roots,
+	// which it may have walked past before they changed. It is nil when no
+	// rebuild is running.
+	rebuilt map[string]bool
+}
+
+var fileIndex = &FileIndex{entries: map[string]IndexEntry{}, basePaths: map[string]string{}}
+
+const fileIndexFileName = "index.gob"
+
+// Load reads the index saved in dataPath, if there is one, and starts keeping
+// it up to date for the roots in basePaths.
+func (idx *FileIndex) Load(basePaths map[string]string, dataPath string) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	idx.basePaths = basePaths
+	idx.file = filepath.Join(dataPath, fileIndexFileName)
+
+	f, err := os.Open(idx.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading index: %s", err.Error())
+	}
+	defer f.Close()
+	entries := map[string]IndexEntry{}
+	decodeErr := gob.NewDecoder(f).Decode(&entries)
+	if decodeErr != nil {
+		return fmt.Errorf("Error reading index: %s", decodeErr.Error())
+	}
+	idx.entries = entries
+	return nil
+}
+
+// Rebuild walks every root and replaces the index with what it finds. Mime
+// types are carried over from the old index for files that haven't changed.
+// Paths updated during the walk are updated again once it is done, so the
+// new index doesn't lose them.
+func (idx *FileIndex) Rebuild() {
+	start := time.Now()
+	idx.lock.Lock()
+	basePaths := idx.basePaths
+	old := idx.entries
+	idx.rebuilt = map[string]bool{}
+	idx.lock.Unlock()
+
+	entries := map[string]IndexEntry{}
+	for rootName, rootPath := range basePaths {
+		filepath.WalkDir(rootPath, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if isHiddenEntry(d.Name()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if p == rootPath {
+				return nil
+			}
+			info, infoErr := d.Info()
+			if infoErr != nil {
+				return nil
+			}
+			entry := newIndexEntry(rootName, rootPath, p, info, old[p])
+			entries[p] = entry
+			return nil
+		})
+	}
+
+	idx.lock.Lock()
+	idx.entries = entries
+	idx.dirty = true
+	rebuilt := idx.rebuilt
+	idx.rebuilt = nil
+	idx.lock.Unlock()
+	for p := range rebuilt {
+		idx.Update(p)
+	}
+	indexLog.Info("indexed", "files", len(entries), "duration", time.Since(start))
+	idx.Save()
+}
+
+func newIndexEntry(rootName string, rootPath string, path string, info os.FileInfo, previous IndexEntry) IndexEntry {
+	entry := IndexEntry{Root: rootName, Path: toVirtualPath(path, rootPath, "/"+rootName), Type: "file", Name: info.Name(), Size: int(info.Size()), Modified: int(info.ModTime().Unix())}
+	if info.IsDir() {
+		entry.Type = "directory"
+		entry.Size = 0
+		return entry
+	}
+	if previous.MimeType != "" && previous.Size == entry.Size && previous.Modified == entry.Modified {
+		entry.MimeType = previous.MimeType
+	} else {
+		entry.MimeType = getMimeType(path, info)
+	}
+	return entry
+}
+
+// SetRoots changes the roots the index covers. The index only catches up
+// with them when it is next rebuilt.
+func (idx *FileIndex) SetRoots(basePaths map[string]string) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	idx.basePaths = basePaths
+}
+
+// Roots returns the roots the index covers.
+func (idx *FileIndex) Roots() map[string]string {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	return idx.basePaths
+}
+
+// Files returns the entries of every file in the index, keyed by real path.
+func (idx *FileIndex) Files() map[string]IndexEntry {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	files := map[string]IndexEntry{}
+	for path, entry := range idx.entries {
+		if entry.Type == "file" {
+			files[path] = entry
+		}
+	}
+	return files
+}
+
+// Update re-indexes the file or directory at path after it has changed. If it
+// no longer exists it is dropped from the index along with anything below it.
+func (idx *FileIndex) Update(path string) {
+	path = filepath.Clean(path)
+	idx.lock.RLock()
+	rootName, rootPath, ok := getRootOf(idx.basePaths, path)
+	idx.lock.RUnlock()
+	if !ok || path == rootPath {
+		return
+	}
+
+	updated := map[string]IndexEntry{}
+	filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if isHiddenEntry(d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info, infoErr := d.Info(); infoErr == nil {
+			updated[p] = newIndexEntry(rootName, rootPath, p, info, IndexEntry{})
+		}
+		return nil
+	})
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	idx.dirty = true
+	if idx.rebuilt != nil {
+		idx.rebuilt[path] = true
+	}
+	prefix := path + string(filepath.Separator)
+	for indexed := range idx.entries {
+		if indexed == path || strings.HasPrefix(indexed, prefix) {
+			delete(idx.entries, indexed)
+		}
+	}
+	for p, entry := range updated {
+		idx.entries[p] = entry
+	}
+}
+
+// Save writes the index to disk if it has changed since it was last saved.
+func (idx *FileIndex) Save() {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if !idx.dirty || idx.file == "" {
+		return
+	}
+	mkdirErr := os.MkdirAll(filepath.Dir(idx.file), 0777)
+	if mkdirErr != nil {
+		indexLog.Error("error saving index", "error", mkdirErr)
+		return
+	}
+	tmp := idx.file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		indexLog.Error("error saving index", "error", err)
+		return
+	}
+	encodeErr := gob.NewEncoder(f).Encode(idx.entries)
+	closeErr := f.Close()
+	if encodeErr != nil || closeErr != nil {
+		indexLog.Error("error saving index", "error", errors.Join(encodeErr, closeErr))
+		os.Remove(tmp)
+		return
+	}
+	renameErr := os.Rename(tmp, idx.file)
+	if renameErr != nil {
+		indexLog.Error("error saving index", "error", renameErr)
+		return
+	}
+	idx.dirty = false
+}
+
+// SaveIndex runs forever, writing the indexes and file owners to disk whenever
+// they have changed.
+func SaveIndex(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		saveIndexes()
+	}
+}
+
+func saveIndexes() {
+	fileIndex.Save()
+	contentIndex.Save()
+	quotas.Save()
+}
+
+type SearchQuery struct {
+	Query   string
+	Fuzzy   bool
+	Type    string
+	Mime    string
+	MinSize int
+	MaxSize int // 0 for no limit
+	After   int // unix time, 0 for no limit
+	Before  int // unix time, 0 for no limit
+	Roots   []string
+	Limit   int
+}
+
+const defaultSearchLimit = 100
+const maxSearchLimit = 1000
+
+func parseSearchQuery(query url.Values) (SearchQuery, error) {
+	q := SearchQuery{Query: strings.ToLower(query.Get("q")), Fuzzy: query.Get("fuzzy") == "true", Type: query.Get("type"), Mime: strings.TrimSuffix(query.Get("mime"), "*"), Roots: query["root"], Limit: defaultSearchLimit}
+	if q.Type != "" && q.Type != "file" && q.Type != "directory" {
+		return q, newError(codeBadRequest, "Unknown type %s", q.Type)
+	}
+	ints := []struct {
+		name  string
+		value *int
+	}{{"minSize", &q.MinSize}, {"maxSize", &q.MaxSize}, {"after", &q.After}, {"before", &q.Before}, {"limit", &q.Limit}}
+	for _, i := range ints {
+		s := query.Get(i.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return q, newError(codeBadRequest, "Invalid %s %s", i.name, s)
+		}
+		*i.value = n
+	}
+	q.Limit = min(max(q.Limit, 1), maxSearchLimit)
+	return q, nil
+}
+
+// Search returns the entries matching q, best matches first.
+func (idx *FileIndex) Search(q SearchQuery) []IndexEntry {
+	type result struct {
+		entry IndexEntry
+		score int
+	}
+	results := []result{}
+
+	idx.lock.RLock()
+	for _, entry := range idx.entries {
+		if q.Type != "" && entry.Type != q.Type {
+			continue
+		}
+		if len(q.Roots) > 0 && !slices.Contains(q.Roots, entry.Root) {
+			continue
+		}
+		if q.Mime != "" && !strings.HasPrefix(entry.MimeType, q.Mime) {
+			continue
+		}
+		if entry.Size < q.MinSize || (q.MaxSize > 0 && entry.Size > q.MaxSize) {
+			continue
+		}
+		if (q.After > 0 && entry.Modified < q.After) || (q.Before > 0 && entry.Modified > q.Before) {
+			continue
+		}
+		score, matched := matchName(strings.ToLower(entry.Name), q.Query, q.Fuzzy)
+		if !matched {
+			continue
+		}
+		results = append(results, result{entry: entry, score: score})
+	}
+	idx.lock.RUnlock()
+
+	slices.SortFunc(results, func(a, b result) int {
+		if c := cmp.Compare(b.score, a.score); c != 0 {
+			return c
+		}
+		return strings.Compare(a.entry.Path, b.entry.Path)
+	})
+	entries := []IndexEntry{}
+	for _, r := range results[:min(len(results), q.Limit)] {
+		entries = append(entries, r.entry)
+	}
+	return entries
+}
+
+// matchName scores how well name matches query, higher being better. Exact
+// names beat prefixes, which beat substrings. Fuzzy matches only need the
+// query's characters to appear in order, and score lower the more spread out
+// they are.
+func matchName(name string, query string, fuzzy bool) (int, bool) {
+	if query == "" {
+		return 0, true
+	}
+	if name == query {
+		return 3000, true
+	}
+	if strings.HasPrefix(name, query) {
+		return 2000, true
+	}
+	if strings.Contains(name, query) {
+		return 1000, true
+	}
+	if !fuzzy {
+		return 0, false
+	}
+	gaps := 0
+	rest := name
+	for _, r := range query {
+		i := strings.IndexRune(rest, r)
+		if i < 0 {
+			return 0, false
+		}
+		gaps += i
+		rest = rest[i+utf8.RuneLen(r):]
+	}
+	return max(999-gaps, 0), true
+}
+
+// SearchFiles sends the results of q as a JSON array.
+func SearchFiles(q SearchQuery, c chan<- string, cErr chan<- error) {
+	defer close(cErr)
+	defer close(c)
+
+	s, err := json.Marshal(fileIndex.Search(q))
+	if err != nil {
+		cErr <- fmt.Errorf("Error marshalling search results: %s", err.Error())
+		return
+	}
+	c <- string(s)
+}
+
+// getRootOf finds the root that the real path sits in.
+func getRootOf(basePaths map[string]string, path string) (string, string, bool) {
+	for rootName, rootPath := range basePaths {
+		rootPath = filepath.Clean(rootPath)
+		if path == rootPath || strings.HasPrefix(path, rootPath+string(filepath.Separator)) {
+			return rootName, rootPath, true
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestMatchName(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		fuzzy     bool
+		wantScore int
+		wantOK    bool
+	}{
+		{"report.pdf", "", false, 0, true},
+		{"report.pdf", "report.pdf", false, 3000, true},
+		{"report.pdf", "rep", false, 2000, true},
+		{"report.pdf", "port", false, 1000, true},
+		{"report.pdf", "rpt", false, 0, false},
+		{"report.pdf", "rpt", true, 996, true},
+		{"report.pdf", "rep", true, 2000, true},
+		{"report.pdf", "tpr", true, 0, false},
+		{"résumé.doc", "rsm", true, 996, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"/"+tt.query, func(t *testing.T) {
+			score, ok := matchName(tt.name, tt.query, tt.fuzzy)
+			if score != tt.wantScore || ok != tt.wantOK {
+				t.Errorf("got %d, %v, want %d, %v", score, ok, tt.wantScore, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    SearchQuery
+		wantErr bool
+	}{
+		{"defaults", "", SearchQuery{Limit: defaultSearchLimit}, false},
+		{"lowercased", "q=Report", SearchQuery{Query: "report", Limit: defaultSearchLimit}, false},
+		{"filters", "q=a&fuzzy=true&type=file&mime=image/*&minSize=1&maxSize=2&after=3&before=4&root=r&root=s&limit=5",
+			SearchQuery{Query: "a", Fuzzy: true, Type: "file", Mime: "image/", MinSize: 1, MaxSize: 2, After: 3, Before: 4, Roots: []string{"r", "s"}, Limit: 5}, false},
+		{"limit capped", "limit=5000", SearchQuery{Limit: maxSearchLimit}, false},
+		{"limit at least one", "limit=0", SearchQuery{Limit: 1}, false},
+		{"unknown type", "type=link", SearchQuery{}, true},
+		{"negative size", "minSize=-1", SearchQuery{}, true},
+		{"not a number", "after=yesterday", SearchQuery{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, parseErr := url.ParseQuery(tt.query)
+			if parseErr != nil {
+				t.Fatal(parseErr)
+			}
+			got, err := parseSearchQuery(values)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got %v, want an error: %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if getErrorCode(err) != codeBadRequest {
+					t.Errorf("got code %s, want %s", getErrorCode(err), codeBadRequest)
+				}
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,68 +1,312 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"rnas/streaming"
 	"slices"
 	"strings"
+	"syscall"
+	"time"
 )
 
-func Serve(basePaths map[string]string, streamablePath string, chunkSize int, port int) {
-	http.HandleFunc("/", handler(basePaths, streamablePath, chunkSize))
+// Serve runs the server with config until it is sent SIGTERM or a listener
+// fails, then shuts down gracefully. args are the command line flags it was
+// started with, which are applied again whenever the config is reloaded.
+func Serve(config Config, args []string) {
+	settings := newSettings(config)
+	currentSettings.Store(settings)
+	basePaths := settings.BasePaths
+	dataPath := config.DataPath
+	rescanInterval := time.Duration(config.RescanIntervalMinutes) * time.Minute
 
-	fmt.Println("Listening on port", port)
-	http.ListenAndServe(fmt.Sprint(":", port), nil)
+	http.HandleFunc("/", handler())
+	http.HandleFunc("/_trash/", trashHandler())
+	http.HandleFunc("/_versions/", versionsHandler())
+	http.HandleFunc("/_du/", usageHandler())
+	http.HandleFunc("/_search", searchHandler())
+	http.HandleFunc("/_search/content", contentSearchHandler())
+	http.HandleFunc("/_changes", changesHandler())
+	http.HandleFunc("/_jobs", jobsHandler())
+	http.HandleFunc("/_jobs/", jobsHandler())
+	http.HandleFunc("/_shares", sharesHandler())
+	http.HandleFunc("/_shares/", sharesHandler())
+	http.HandleFunc("/_s/", sharedHandler())
+	http.HandleFunc("/_quota", quotaHandler())
+	http.HandleFunc("/_admin/reload", reloadHandler(args))
+	http.HandleFunc("/_admin/log", logLevelHandler())
+	http.HandleFunc("/_admin/audit", auditHandler())
+	http.Handle("/metrics", metricsHandler())
+
+	shareErr := shareStore.Load(dataPath)
+	if shareErr != nil {
+		sharesLog.Error("error loading shares", "error", shareErr)
+	}
+
+	indexErr := fileIndex.Load(basePaths, dataPath)
+	if indexErr != nil {
+		indexLog.Warn("error loading index, rebuilding from scratch", "error", indexErr)
+	}
+	contentIndexErr := contentIndex.Load(dataPath)
+	if contentIndexErr != nil {
+		indexLog.Warn("error loading content index, rebuilding from scratch", "error", contentIndexErr)
+	}
+	quotaErr := quotas.Load(basePaths, config.QuotaConfig(), dataPath)
+	if quotaErr != nil {
+		quotaLog.Error("error loading file owners", "error", quotaErr)
+	}
+	streaming.Configure(config.StreamingOutputs())
+	transcodeErr := transcodeStore.Load(dataPath, config.Streaming.Path)
+	if transcodeErr != nil {
+		streamingLog.Error("error loading transcodes", "error", transcodeErr)
+	}
+	auditErr := auditLog.Open(dataPath, config.Audit)
+	if auditErr != nil {
+		serverLog.Error("error opening audit log", "error", auditErr)
+	}
+	setCacheLimits(config.Cache)
+	subscribeCaches()
+	changeFeed.Start(basePaths)
+	go WatchRoots(basePaths, rescanInterval)
+	go ReloadOnSignal(args)
+	go rescanRoots()
+	go contentIndex.Work()
+	go SaveIndex(time.Minute)
+
+	go SweepTrash(time.Hour)
+	go SweepVersions(time.Hour)
+
+	servers := []*http.Server{}
+	cListen := make(chan error, len(config.Listen))
+	for _, listener := range config.Listen {
+		server := &http.Server{Addr: listener.Address, Handler: instrumentHandler(logRequests(auditRequests(http.DefaultServeMux)))}
+		servers = append(servers, server)
+		go func() {
+			serverLog.Info("listening", "address", listener.Address, "tls", listener.TLSCert != "")
+			var err error
+			if listener.TLSCert != "" {
+				err = server.ListenAndServeTLS(listener.TLSCert, listener.TLSKey)
+			} else {
+				err = server.ListenAndServe()
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				cListen <- err
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-cListen:
+		serverLog.Error("error listening", "error", err)
+	case sig := <-signals:
+		serverLog.Info("received signal", "signal", sig)
+	}
+	Shutdown(servers)
 }
 
-func handler(basePaths map[string]string, streamablePath string, chunkSize int) func(http.ResponseWriter, *http.Request) {
+func handler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		settings := getSettings()
+		basePaths, rootOptions, streamablePath := settings.BasePaths, settings.RootOptions, settings.StreamablePath
+		chunkSize, versionRetention := settings.ChunkSize, settings.VersionRetention
 		flusher, flusherok := w.(http.Flusher)
 		if !flusherok {
-			http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+			writeError(w, newError(codeInternal, "Streaming unsupported!"))
 			return
 		}
 		path := r.URL.Path
 		pathParts := strings.Split(path, "/")
-		fmt.Println("path prefix", pathParts[1])
-		fmt.Println("full", r.FormValue("something"))
 		realPath, realPathExists := basePaths[pathParts[1]]
-		if realPath != "" && !realPathExists {
-			http.Error(w, fmt.Sprint("Path ", path, " not found!"), http.StatusNotFound)
+		if pathParts[1] != "" && !realPathExists {
+			writeError(w, newError(codeNotFound, "Path %s not found!", path))
+			return
+		}
+		if slices.ContainsFunc(pathParts, isHiddenEntry) {
+			writeError(w, newError(codeNotFound, "Path %s not found!", path))
 			return
 		}
-		fmt.Println("base path", realPath)
 		fullPath := strings.Join(slices.Concat([]string{realPath}, pathParts[2:]), "/")
-		fmt.Println("full path", fullPath)
+		httpLog.DebugContext(r.Context(), "resolved path", "root", pathParts[1], "path", fullPath)
 
-		fmt.Println("method:", r.Method)
+		query := r.URL.Query()
+		switch {
+		case r.Method == http.MethodPost && query.Has("mkdir"):
+			auditAction(r.Context(), auditMkdir, path, fullPath, "")
+		case r.Method == http.MethodPost:
+			auditAction(r.Context(), auditWrite, path, fullPath, "")
+		case r.Method == http.MethodDelete:
+			action, detail := auditTrash, ""
+			if query.Get("permanent") == "true" {
+				action = auditDelete
+			}
+			if query.Get("recursive") == "true" {
+				detail = "recursive"
+			}
+			auditAction(r.Context(), action, path, fullPath, detail)
+		}
+		if r.Method == http.MethodPost || r.Method == http.MethodDelete {
+			writableErr := checkWritable(rootOptions, pathParts[1])
+			if writableErr != nil {
+				writeError(w, writableErr)
+				return
+			}
+		}
 		if r.Method == http.MethodPost {
-			post(w, r.Body, flusher, fullPath, chunkSize)
+			if query.Has("mkdir") {
+				mkdir(r.Context(), w, flusher, fullPath, query.Get("parents") == "true")
+				return
+			}
+			user := quotas.UserOf(r)
+			quotaErr := checkDeclaredUpload(realPath, user, r.ContentLength)
+			if quotaErr != nil {
+				writeError(w, quotaErr)
+				return
+			}
+			post(r.Context(), w, r.Body, flusher, fullPath, realPath, query.Get("conflict"), parseIfMatch(r.Header.Get("If-Match")), versionRetention, user, nil, chunkSize)
 			return
 		}
 		if r.Method == http.MethodDelete {
-			del(w, flusher, fullPath, path, streamablePath)
+			recursive := query.Get("recursive") == "true"
+			if query.Get("permanent") != "true" {
+				trash(r.Context(), w, flusher, fullPath, path, pathParts[1], realPath, recursive, query.Get("confirm"))
+				return
+			}
+			if recursive {
+				delRecursive(r.Context(), w, flusher, fullPath, path, streamablePath, query.Get("confirm"))
+				return
+			}
+			del(r.Context(), w, flusher, fullPath, path, streamablePath)
+			return
+		}
+
+		if query.Has("archive") {
+			archiveOptions, archiveErr := parseArchiveOptions(query)
+			if archiveErr != nil {
+				writeError(w, archiveErr)
+				return
+			}
+			if pathParts[1] == "" {
+				writeError(w, newError(codeBadRequest, "Only directories inside a root can be archived"))
+				return
+			}
+			archive(w, flusher, fullPath, path, archiveOptions, r.Context().Done(), chunkSize)
 			return
 		}
 
-		get(w, flusher, fullPath, basePaths, path, streamablePath, chunkSize)
+		listOptions, listErr := parseListOptions(query, r.Header.Get("Accept"))
+		if listErr != nil {
+			writeError(w, listErr)
+			return
+		}
+		w.Header().Set("Vary", "Accept")
+		if info, statErr := os.Stat(fullPath); statErr == nil && info.Mode().IsRegular() {
+			w.Header().Set("ETag", getETag(info))
+		} else if statErr == nil && info.IsDir() && listOptions.NDJSON {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		get(r.Context(), w, flusher, fullPath, getVisibleRoots(basePaths, rootOptions), path, getRootStreamablePath(rootOptions, pathParts[1], streamablePath), listOptions, chunkSize)
+	}
+}
+
+// checkWritable refuses changes to a root that is configured as read-only.
+func checkWritable(rootOptions map[string]RootOptions, rootName string) error {
+	if rootOptions[rootName].ReadOnly {
+		return newError(codeForbidden, "Root %s is read-only", rootName)
+	}
+	return nil
+}
+
+// checkAdmin refuses requests that don't carry the admin token as a bearer
+// token. Without a token configured, admin endpoints refuse everything, and
+// the endpoints that only need it if there is one let everything through.
+func checkAdmin(w http.ResponseWriter, r *http.Request, required bool) error {
+	token := getSettings().Config.Auth.AdminToken
+	if token == "" {
+		if required {
+			return newError(codeForbidden, "Admin endpoints are disabled until auth.admin_token is set")
+		}
+		return nil
+	}
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		return newError(codeUnauthorized, "Admin token required")
+	}
+	return nil
+}
+
+// getVisibleRoots leaves out the roots that are hidden from the top level
+// listing. They can still be reached by name.
+func getVisibleRoots(basePaths map[string]string, rootOptions map[string]RootOptions) map[string]string {
+	visible := map[string]string{}
+	for name, path := range basePaths {
+		if !rootOptions[name].Hidden {
+			visible[name] = path
+		}
+	}
+	return visible
+}
+
+// getRootStreamablePath returns where the root's videos are transcoded to, or
+// "" if they are served as they are.
+func getRootStreamablePath(rootOptions map[string]RootOptions, rootName string, streamablePath string) string {
+	if !rootOptions[rootName].Streaming {
+		return ""
+	}
+	return streamablePath
+}
+
+func archive(w http.ResponseWriter, flusher http.Flusher, fullPath string, virtualPath string, opts ArchiveOptions, done <-chan struct{}, chunkSize int) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", archiveContentTypes[opts.Format])
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(virtualPath) + "." + opts.Format}))
+	declareStreamTrailers(w)
+
+	cArchive := make(chan []byte)
+	cErr := make(chan error)
+	go WriteArchive(fullPath, virtualPath, opts, done, cArchive, cErr, chunkSize)
+	started := false
+	for chunk := range cArchive {
+		w.Write(chunk)
+		flusher.Flush()
+		started = true
+	}
+	for err := range cErr {
+		writeStreamError(w, flusher, err, started)
+		return
 	}
+	finishStream(w, nil)
 }
 
-func get(w http.ResponseWriter, flusher http.Flusher, fullPath string, basePaths map[string]string, path string, streamablePath string, chunkSize int) {
+func get(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, fullPath string, basePaths map[string]string, path string, streamablePath string, listOptions ListOptions, chunkSize int) {
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Transfer-Encoding", "chunked")
+	declareStreamTrailers(w)
 
 	cDir := make(chan string)
 	cFile := make(chan []byte)
 	cErr := make(chan error)
 
-	go Read(fullPath, basePaths, path, streamablePath, cErr, cDir, cFile, chunkSize)
+	served := bytesServed.WithLabelValues(strings.Split(path, "/")[1])
+	go Read(ctx, fullPath, basePaths, path, streamablePath, listOptions, cErr, cDir, cFile, chunkSize)
 	func(w http.ResponseWriter, cErr <-chan error, cDir <-chan string, cFile <-chan []byte) {
 		cFileClosed := false
 		cDirClosed := false
 		cErrClosed := false
+		started := false
 		for !cFileClosed || !cDirClosed || !cErrClosed {
 			select {
 			case fsItem, fsItemOk := <-cDir:
@@ -71,6 +315,7 @@ func get(w http.ResponseWriter, flusher http.Flusher, fullPath string, basePaths
 					break
 				}
 				w.Write([]byte(fsItem))
+				started = true
 			case chunk, chunkOk := <-cFile:
 				if !chunkOk {
 					cFileClosed = true
@@ -78,70 +323,694 @@ func get(w http.ResponseWriter, flusher http.Flusher, fullPath string, basePaths
 				}
 				w.Write(chunk)
 				flusher.Flush()
+				served.Add(float64(len(chunk)))
+				started = true
 			case err, errOk := <-cErr:
 				if !errOk {
 					cErrClosed = true
 					break
 				}
-				fmt.Println("error", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				flusher.Flush()
+				writeStreamError(w, flusher, err, started)
 				return
 			}
 		}
+		finishStream(w, nil)
 		flusher.Flush()
 	}(w, cErr, cDir, cFile)
 }
 
-func post(w http.ResponseWriter, body io.ReadCloser, flusher http.Flusher, fullPath string, chunkSize int) {
+func post(ctx context.Context, w http.ResponseWriter, body io.ReadCloser, flusher http.Flusher, fullPath string, rootPath string, conflict string, ifMatch []string, versionRetention VersionRetention, user string, accept func([]File) error, chunkSize int) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	cResult := make(chan string)
+	cErr := make(chan error)
+
+	go Write(ctx, fullPath, rootPath, body, conflict, ifMatch, versionRetention, user, accept, cResult, cErr, chunkSize)
+	writeJSONResult(w, flusher, cResult, cErr)
+}
+
+func del(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, fullPath string, virtualPath string, streamablePath string) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	cErr := make(chan error)
+
+	go Delete(ctx, fullPath, virtualPath, streamablePath, cErr)
+	writeEmptyResult(w, flusher, cErr)
+}
+
+func mkdir(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, fullPath string, parents bool) {
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.WriteHeader(http.StatusOK)
 
 	cErr := make(chan error)
 
-	go Write(fullPath, body, cErr, chunkSize)
-	func(w http.ResponseWriter, cErr <-chan error) {
+	go MakeDir(ctx, fullPath, parents, cErr)
+	writeEmptyResult(w, flusher, cErr)
+}
+
+func delRecursive(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, fullPath string, virtualPath string, streamablePath string, confirm string) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	declareStreamTrailers(w)
+
+	cProgress := make(chan string)
+	cErr := make(chan error)
+
+	go DeleteRecursive(ctx, fullPath, virtualPath, streamablePath, confirm, cProgress, cErr)
+	func(w http.ResponseWriter, cProgress <-chan string, cErr <-chan error) {
+		cProgressClosed := false
 		cErrClosed := false
-		for !cErrClosed {
+		started := false
+		for !cProgressClosed || !cErrClosed {
 			select {
+			case progress, progressOk := <-cProgress:
+				if !progressOk {
+					cProgressClosed = true
+					break
+				}
+				w.Write([]byte(progress + "\n"))
+				flusher.Flush()
+				started = true
 			case err, errOk := <-cErr:
 				if !errOk {
 					cErrClosed = true
 					break
 				}
-				fmt.Println("error", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				flusher.Flush()
+				writeStreamError(w, flusher, err, started)
 				return
 			}
 		}
-		w.WriteHeader(http.StatusOK)
-	}(w, cErr)
+		finishStream(w, nil)
+		flusher.Flush()
+	}(w, cProgress, cErr)
 }
 
-func del(w http.ResponseWriter, flusher http.Flusher, fullPath string, virtualPath string, streamablePath string) {
+func trash(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, fullPath string, virtualPath string, rootName string, rootPath string, recursive bool, confirm string) {
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
+	cItem := make(chan string)
 	cErr := make(chan error)
 
-	go Delete(fullPath, virtualPath, streamablePath, cErr)
-	func(w http.ResponseWriter, cErr <-chan error) {
-		cErrClosed := false
-		for !cErrClosed {
-			select {
-			case err, errOk := <-cErr:
-				if !errOk {
-					cErrClosed = true
-					break
-				}
-				fmt.Println("error", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+	go Trash(ctx, fullPath, virtualPath, rootName, rootPath, recursive, confirm, cItem, cErr)
+	writeJSONResult(w, flusher, cItem, cErr)
+}
+
+// trashHandler serves the trash of every root:
+//
+//	GET    /_trash[/<root>]       list trashed items
+//	POST   /_trash/<root>/<id>    restore an item to its original path
+//	DELETE /_trash/<root>[/<id>]  permanently purge one item or the whole trash
+func trashHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		settings := getSettings()
+		basePaths, rootOptions, streamablePath := settings.BasePaths, settings.RootOptions, settings.StreamablePath
+		flusher, flusherok := w.(http.Flusher)
+		if !flusherok {
+			writeError(w, newError(codeInternal, "Streaming unsupported!"))
+			return
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		pathParts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/_trash"), "/"), "/")
+		rootName := pathParts[0]
+		id := ""
+		if len(pathParts) > 1 {
+			id = pathParts[1]
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			auditAction(r.Context(), auditRestore, "/"+rootName, "", "trash item "+id)
+		case http.MethodDelete:
+			detail := "trash item " + id
+			if id == "" {
+				detail = "all of the trash"
+			}
+			auditAction(r.Context(), auditPurge, "/"+rootName, basePaths[rootName], detail)
+		}
+		if r.Method == http.MethodPost || r.Method == http.MethodDelete {
+			writableErr := checkWritable(rootOptions, rootName)
+			if writableErr != nil {
+				writeError(w, writableErr)
+				return
+			}
+		}
+
+		cErr := make(chan error)
+		switch r.Method {
+		case http.MethodGet:
+			cItems := make(chan string)
+			go ListTrash(basePaths, rootName, cItems, cErr)
+			writeJSONResult(w, flusher, cItems, cErr)
+		case http.MethodPost:
+			go RestoreTrash(r.Context(), basePaths, rootName, id, cErr)
+			writeEmptyResult(w, flusher, cErr)
+		case http.MethodDelete:
+			if rootName == "" {
+				writeError(w, newError(codeBadRequest, "A root must be given to purge the trash"))
+				return
+			}
+			go PurgeTrash(r.Context(), basePaths, rootName, id, streamablePath, cErr)
+			writeEmptyResult(w, flusher, cErr)
+		default:
+			writeError(w, newError(codeMethodNotAllowed, "Method %s not allowed", r.Method))
+		}
+	}
+}
+
+// versionsHandler serves the saved versions of overwritten files:
+//
+//	GET  /_versions/<path>               list versions of the file at <path>
+//	GET  /_versions/<path>?version=<id>  download one version
+//	POST /_versions/<path>?version=<id>  restore a version over the current file
+func versionsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		settings := getSettings()
+		basePaths, rootOptions := settings.BasePaths, settings.RootOptions
+		chunkSize, versionRetention := settings.ChunkSize, settings.VersionRetention
+		flusher, flusherok := w.(http.Flusher)
+		if !flusherok {
+			writeError(w, newError(codeInternal, "Streaming unsupported!"))
+			return
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		path := strings.TrimPrefix(r.URL.Path, "/_versions")
+		pathParts := strings.Split(path, "/")
+		rootPath, rootExists := basePaths[pathParts[1]]
+		if !rootExists || len(pathParts) < 3 || slices.ContainsFunc(pathParts, isHiddenEntry) {
+			writeError(w, newError(codeNotFound, "Path %s not found!", path))
+			return
+		}
+		fullPath := strings.Join(slices.Concat([]string{rootPath}, pathParts[2:]), "/")
+		id := r.URL.Query().Get("version")
+
+		cErr := make(chan error)
+		switch {
+		case r.Method == http.MethodGet && id == "":
+			cVersions := make(chan string)
+			go ListVersions(fullPath, rootPath, cVersions, cErr)
+			writeJSONResult(w, flusher, cVersions, cErr)
+		case r.Method == http.MethodGet:
+			declareStreamTrailers(w)
+			cFile := make(chan []byte)
+			go ReadVersion(fullPath, rootPath, id, cFile, cErr, chunkSize)
+			started := false
+			for chunk := range cFile {
+				w.Write(chunk)
 				flusher.Flush()
+				started = true
+			}
+			for err := range cErr {
+				writeStreamError(w, flusher, err, started)
 				return
 			}
+			finishStream(w, nil)
+		case r.Method == http.MethodPost:
+			auditAction(r.Context(), auditRestoreVersion, path, fullPath, "version "+id)
+			writableErr := checkWritable(rootOptions, pathParts[1])
+			if writableErr != nil {
+				writeError(w, writableErr)
+				return
+			}
+			cResult := make(chan string)
+			go RestoreVersion(r.Context(), fullPath, rootPath, id, versionRetention, cResult, cErr)
+			writeJSONResult(w, flusher, cResult, cErr)
+		default:
+			writeError(w, newError(codeMethodNotAllowed, "Method %s not allowed", r.Method))
+		}
+	}
+}
+
+// usageHandler serves the disk usage of any virtual path:
+//
+//	GET /_du/<path>  total size, file and directory counts and mime breakdown
+func usageHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		basePaths := getSettings().BasePaths
+		flusher, flusherok := w.(http.Flusher)
+		if !flusherok {
+			writeError(w, newError(codeInternal, "Streaming unsupported!"))
+			return
 		}
-		w.Write([]byte("{}"))
-	}(w, cErr)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if r.Method != http.MethodGet {
+			writeError(w, newError(codeMethodNotAllowed, "Method %s not allowed", r.Method))
+			return
+		}
+
+		path := "/" + strings.Trim(strings.TrimPrefix(r.URL.Path, "/_du"), "/")
+		pathParts := strings.Split(path, "/")
+		rootPath, rootExists := basePaths[pathParts[1]]
+		if (pathParts[1] != "" && !rootExists) || slices.ContainsFunc(pathParts, isHiddenEntry) {
+			writeError(w, newError(codeNotFound, "Path %s not found!", path))
+			return
+		}
+		fullPath := ""
+		if rootExists {
+			fullPath = strings.Join(slices.Concat([]string{rootPath}, pathParts[2:]), "/")
+		}
+
+		cUsage := make(chan string)
+		cErr := make(chan error)
+		go ReadDiskUsage(fullPath, path, basePaths, cUsage, cErr)
+		writeJSONResult(w, flusher, cUsage, cErr)
+	}
+}
+
+// searchHandler searches the names and metadata of everything in every root:
+//
+//	GET /_search?q=<name>  with optional fuzzy=true, type, mime, minSize,
+//	                       maxSize, after, before, limit and repeated root
+func searchHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, flusherok := w.(http.Flusher)
+		if !flusherok {
+			writeError(w, newError(codeInternal, "Streaming unsupported!"))
+			return
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if r.Method != http.MethodGet {
+			writeError(w, newError(codeMethodNotAllowed, "Method %s not allowed", r.Method))
+			return
+		}
+		q, err := parseSearchQuery(r.URL.Query())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		cResults := make(chan string)
+		cErr := make(chan error)
+		go SearchFiles(q, cResults, cErr)
+		writeJSONResult(w, flusher, cResults, cErr)
+	}
+}
+
+// contentSearchHandler searches the text of every document in every root:
+//
+//	GET /_search/content?q=<words>  with optional limit and repeated root
+func contentSearchHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, flusherok := w.(http.Flusher)
+		if !flusherok {
+			writeError(w, newError(codeInternal, "Streaming unsupported!"))
+			return
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if r.Method != http.MethodGet {
+			writeError(w, newError(codeMethodNotAllowed, "Method %s not allowed", r.Method))
+			return
+		}
+		q, err := parseContentQuery(r.URL.Query())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		cResults := make(chan string)
+		cErr := make(chan error)
+		go SearchContents(q, cResults, cErr)
+		writeJSONResult(w, flusher, cResults, cErr)
+	}
+}
+
+// jobsHandler runs extractions and compressions in the background:
+//
+//	POST   /_jobs?type=extract&source=<archive>&target=<directory>
+//	POST   /_jobs?type=compress&source=<directory>&target=<archive>
+//	                    both with optional conflict=error|rename
+//	GET    /_jobs       list running and recently finished jobs
+//	GET    /_jobs/<id>  progress of one job
+//	DELETE /_jobs/<id>  cancel a job
+func jobsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		settings := getSettings()
+		basePaths, rootOptions, versionRetention := settings.BasePaths, settings.RootOptions, settings.VersionRetention
+		flusher, flusherok := w.(http.Flusher)
+		if !flusherok {
+			writeError(w, newError(codeInternal, "Streaming unsupported!"))
+			return
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		adminErr := checkAdmin(w, r, false)
+		if adminErr != nil {
+			writeError(w, adminErr)
+			return
+		}
+
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/_jobs"), "/")
+		query := r.URL.Query()
+		c := make(chan string)
+		cErr := make(chan error)
+		switch {
+		case r.Method == http.MethodGet && id == "":
+			go ListJobs(c, cErr)
+			writeJSONResult(w, flusher, c, cErr)
+		case r.Method == http.MethodGet:
+			go ReadJob(id, c, cErr)
+			writeJSONResult(w, flusher, c, cErr)
+		case r.Method == http.MethodPost && id == "":
+			auditAction(r.Context(), auditJobStart, query.Get("source"), "", fmt.Sprintf("%s to %s", query.Get("type"), query.Get("target")))
+			if targetRoot, _, _, err := resolveVirtualPath(basePaths, query.Get("target")); err == nil {
+				if writableErr := checkWritable(rootOptions, targetRoot); writableErr != nil {
+					writeError(w, writableErr)
+					return
+				}
+			}
+			go StartJob(basePaths, query.Get("type"), query.Get("source"), query.Get("target"), query.Get("conflict"), versionRetention, quotas.UserOf(r), c, cErr)
+			writeJSONResult(w, flusher, c, cErr)
+		case r.Method == http.MethodDelete && id != "":
+			auditAction(r.Context(), auditJobCancel, "", "", "job "+id)
+			go CancelJob(id, cErr)
+			writeEmptyResult(w, flusher, cErr)
+		default:
+			writeError(w, newError(codeMethodNotAllowed, "Method %s not allowed", r.Method))
+		}
+	}
+}
+
+// sharesHandler manages share links:
+//
+//	POST   /_shares       create a share from a JSON NewShare
+//	GET    /_shares       list shares that can still be used
+//	DELETE /_shares/<id>  revoke a share
+func sharesHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		basePaths := getSettings().BasePaths
+		flusher, flusherok := w.(http.Flusher)
+		if !flusherok {
+			writeError(w, newError(codeInternal, "Streaming unsupported!"))
+			return
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		adminErr := checkAdmin(w, r, false)
+		if adminErr != nil {
+			writeError(w, adminErr)
+			return
+		}
+
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/_shares"), "/")
+		c := make(chan string)
+		cErr := make(chan error)
+		switch {
+		case r.Method == http.MethodPost && id == "":
+			auditAction(r.Context(), auditShareCreate, "", "", "")
+			go CreateShare(r.Context(), basePaths, r.Body, c, cErr)
+			writeJSONResult(w, flusher, c, cErr)
+		case r.Method == http.MethodGet && id == "":
+			go ListShares(c, cErr)
+			writeJSONResult(w, flusher, c, cErr)
+		case r.Method == http.MethodDelete && id != "":
+			auditAction(r.Context(), auditShareRevoke, "", "", "share "+id)
+			go RevokeShare(r.Context(), id, cErr)
+			writeEmptyResult(w, flusher, cErr)
+		default:
+			writeError(w, newError(codeMethodNotAllowed, "Method %s not allowed", r.Method))
+		}
+	}
+}
+
+// sharedHandler serves whatever a share link gives access to, and nothing
+// else. Passwords are given in the X-Share-Password header or the password
+// query parameter.
+//
+//	GET  /_s/<token>/<path>  download a shared file, or anything in a shared
+//	                         directory, counting towards the download limit
+//	                         (HLS output for a video is not counted)
+//	POST /_s/<token>/        upload files to an upload-only share
+func sharedHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		settings := getSettings()
+		basePaths, rootOptions, streamablePath := settings.BasePaths, settings.RootOptions, settings.StreamablePath
+		chunkSize, versionRetention := settings.ChunkSize, settings.VersionRetention
+		flusher, flusherok := w.(http.Flusher)
+		if !flusherok {
+			writeError(w, newError(codeInternal, "Streaming unsupported!"))
+			return
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		query := r.URL.Query()
+		token, subPath, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/_s/"), "/")
+		password := r.Header.Get("X-Share-Password")
+		if password == "" {
+			password = query.Get("password")
+		}
+		share, shareErr := shareStore.Open(token, password)
+		if shareErr != nil {
+			writeError(w, shareErr)
+			return
+		}
+		rootName, rootPath, sharedPath, resolveErr := resolveVirtualPath(basePaths, share.Path)
+		if resolveErr != nil {
+			writeError(w, resolveErr)
+			return
+		}
+		sharedInfo, statErr := os.Stat(sharedPath)
+		if statErr != nil {
+			writeError(w, newError(codeGone, "Shared file or directory no longer exists"))
+			return
+		}
+
+		if share.Mode == shareUpload {
+			if r.Method != http.MethodPost || strings.Trim(subPath, "/") != "" {
+				writeError(w, newError(codeForbidden, "Share only accepts uploads"))
+				return
+			}
+			auditAction(r.Context(), auditWrite, share.Path, sharedPath, "through share "+share.ID)
+			writableErr := checkWritable(rootOptions, rootName)
+			if writableErr != nil {
+				writeError(w, writableErr)
+				return
+			}
+			quotaErr := checkDeclaredUpload(rootPath, "", r.ContentLength)
+			if quotaErr != nil {
+				writeError(w, quotaErr)
+				return
+			}
+			// never reveal or replace what is already there
+			accept := func(files []File) error {
+				return shareStore.AcceptUploads(share.ID, files)
+			}
+			post(r.Context(), w, r.Body, flusher, sharedPath, rootPath, conflictRename, nil, versionRetention, "", accept, chunkSize)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			writeError(w, newError(codeMethodNotAllowed, "Method %s not allowed", r.Method))
+			return
+		}
+		rootStreamablePath := getRootStreamablePath(rootOptions, rootName, streamablePath)
+		virtualPath, pathErr := resolveSharePath(share, sharedInfo.IsDir(), subPath, rootStreamablePath)
+		if pathErr != nil {
+			writeError(w, pathErr)
+			return
+		}
+		_, _, fullPath, resolveErr := resolveVirtualPath(basePaths, virtualPath)
+		if resolveErr != nil {
+			writeError(w, resolveErr)
+			return
+		}
+		listOptions, listErr := parseListOptions(query, r.Header.Get("Accept"))
+		if listErr != nil {
+			writeError(w, listErr)
+			return
+		}
+		info, infoErr := os.Stat(fullPath)
+		isArchive := infoErr == nil && info.IsDir() && query.Has("archive")
+		archiveOptions := ArchiveOptions{}
+		if isArchive {
+			var archiveErr error
+			archiveOptions, archiveErr = parseArchiveOptions(query)
+			if archiveErr != nil {
+				writeError(w, archiveErr)
+				return
+			}
+		}
+		if isArchive || (infoErr == nil && info.Mode().IsRegular() && countsAsDownload(share, virtualPath, fullPath, streamablePath)) {
+			countErr := shareStore.CountDownload(share.ID)
+			if countErr != nil {
+				writeError(w, countErr)
+				return
+			}
+		}
+		if isArchive {
+			archive(w, flusher, fullPath, virtualPath, archiveOptions, r.Context().Done(), chunkSize)
+			return
+		}
+		get(r.Context(), w, flusher, fullPath, basePaths, virtualPath, rootStreamablePath, listOptions, chunkSize)
+	}
+}
+
+// changesHandler streams changes under the given paths as server-sent events:
+//
+//	GET /_changes?path=<virtual path>  with repeated path, optional
+//	                                   recursive=true, and since=<event id> or
+//	                                   a Last-Event-ID header to resume
+func changesHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		basePaths := getSettings().BasePaths
+		flusher, flusherok := w.(http.Flusher)
+		if !flusherok {
+			writeError(w, newError(codeInternal, "Streaming unsupported!"))
+			return
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if r.Method != http.MethodGet {
+			writeError(w, newError(codeMethodNotAllowed, "Method %s not allowed", r.Method))
+			return
+		}
+		query := r.URL.Query()
+		sub, err := parseFeedSubscription(query["path"], query.Get("recursive") == "true", basePaths)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		since := r.Header.Get("Last-Event-ID")
+		if query.Has("since") {
+			since = query.Get("since")
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		c := make(chan string)
+		// feeds never end by themselves, so they are closed on shutdown
+		// rather than holding it up
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-r.Context().Done():
+			case <-shuttingDown:
+			}
+			close(done)
+		}()
+		go WatchFeed(sub, since, done, c)
+		for s := range c {
+			w.Write([]byte(s))
+			flusher.Flush()
+		}
+	}
+}
+
+// writeJSONResult writes whatever arrives on c to the response, stopping at
+// the first error.
+func writeJSONResult(w http.ResponseWriter, flusher http.Flusher, c <-chan string, cErr <-chan error) {
+	cClosed := false
+	cErrClosed := false
+	for !cClosed || !cErrClosed {
+		select {
+		case item, itemOk := <-c:
+			if !itemOk {
+				cClosed = true
+				break
+			}
+			w.Write([]byte(item))
+		case err, errOk := <-cErr:
+			if !errOk {
+				cErrClosed = true
+				break
+			}
+			writeError(w, err)
+			flusher.Flush()
+			return
+		}
+	}
+	flusher.Flush()
+}
+
+// writeEmptyResult waits for an operation to finish and writes an empty JSON
+// object, or the first error it reports.
+func writeEmptyResult(w http.ResponseWriter, flusher http.Flusher, cErr <-chan error) {
+	for err := range cErr {
+		writeError(w, err)
+		flusher.Flush()
+		return
+	}
+	w.Write([]byte("{}"))
+}
+
+// checkDeclaredUpload turns down an upload before its body is read if the
+// length it declares can't fit in what is left of the quota. Files are sent
+// base64 encoded, so they are taken to be three quarters of the body.
+func checkDeclaredUpload(rootPath string, user string, contentLength int64) error {
+	if contentLength <= 0 {
+		return nil
+	}
+	return quotas.Check(rootPath, user, contentLength*3/4, 0)
+}
+
+// quotaHandler reports storage used against the quotas:
+//
+//	GET /_quota  every root's usage, limits and filesystem space, and the
+//	             requesting user's if there are per-user quotas
+func quotaHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, flusherok := w.(http.Flusher)
+		if !flusherok {
+			writeError(w, newError(codeInternal, "Streaming unsupported!"))
+			return
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		if r.Method != http.MethodGet {
+			writeError(w, newError(codeMethodNotAllowed, "Method %s not allowed", r.Method))
+			return
+		}
+		c := make(chan string)
+		cErr := make(chan error)
+		go ReadQuotas(quotas.UserOf(r), c, cErr)
+		writeJSONResult(w, flusher, c, cErr)
+	}
+}
+
+// reloadHandler reloads the config, as SIGHUP does:
+//
+//	POST /_admin/reload  reads the config again and switches to it if it is
+//	                     valid, returning what changed
+func reloadHandler(args []string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if r.Method != http.MethodPost {
+			writeError(w, newError(codeMethodNotAllowed, "Method %s not allowed", r.Method))
+			return
+		}
+		auditAction(r.Context(), auditConfigReload, "", "", "")
+		adminErr := checkAdmin(w, r, true)
+		if adminErr != nil {
+			writeError(w, adminErr)
+			return
+		}
+		changes, err := Reload(args)
+		logReload(changes, err)
+		auditDetail(r.Context(), strings.Join(changes, "; "))
+		if err != nil {
+			writeError(w, newError(codeBadRequest, "Invalid config, keeping the running config:\n%s", err.Error()))
+			return
+		}
+		s, jsonErr := json.Marshal(map[string][]string{"changes": changes})
+		if jsonErr != nil {
+			writeError(w, fmt.Errorf("Error marshalling config changes: %s", jsonErr.Error()))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(s)
+	}
 }
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"rnas/streaming"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// Modes a share can be created with.
+const (
+	shareRead   = "read"   // the shared file or directory can be downloaded
+	shareUpload = "upload" // files can be dropped into the shared directory, but nothing read back
+)
+
+// defaultShareExpiry is how long a share lasts if no expiry is asked for.
+const defaultShareExpiry = 7 * 24 * time.Hour
+
+// sharePasswordIterations is the PBKDF2 work factor for share passwords.
+const sharePasswordIterations = 100000
+
+// Share gives anyone with its link access to one virtual path, without access
+// to the rest of the server.
+type Share struct {
+	ID           string `json:"id"`
+	Path         string `json:"path"` // virtual path
+	Type         string `json:"type"` // "file" or "directory"
+	Mode         string `json:"mode"`
+	Created      int    `json:"created"`
+	Expires      int    `json:"expires"`
+	MaxDownloads int    `json:"maxDownloads,omitempty"` // 0 for no limit
+	Downloads    int    `json:"downloads"`
+	// upload shares only, 0 or empty for no limit
+	MaxBytes      int64    `json:"maxBytes,omitempty"`
+	MaxFiles      int      `json:"maxFiles,omitempty"`
+	AllowedTypes  []string `json:"allowedTypes,omitempty"`
+	UploadedBytes int64    `json:"uploadedBytes"`
+	UploadedFiles int      `json:"uploadedFiles"`
+	PasswordSalt  string   `json:"passwordSalt,omitempty"`
+	PasswordHash  string   `json:"passwordHash,omitempty"`
+}
+
+// ShareInfo is a share as shown to whoever manages it, with its link but
+// without its password.
+type ShareInfo struct {
+	ID            string   `json:"id"`
+	Path          string   `json:"path"`
+	Type          string   `json:"type"`
+	Mode          string   `json:"mode"`
+	Created       int      `json:"created"`
+	Expires       int      `json:"expires"`
+	MaxDownloads  int      `json:"maxDownloads,omitempty"`
+	Downloads     int      `json:"downloads"`
+	MaxBytes      int64    `json:"maxBytes,omitempty"`
+	MaxFiles      int      `json:"maxFiles,omitempty"`
+	AllowedTypes  []string `json:"allowedTypes,omitempty"`
+	UploadedBytes int64    `json:"uploadedBytes"`
+	UploadedFiles int      `json:"uploadedFiles"`
+	Password      bool     `json:"password"`
+	Token         string   `json:"token"`
+	URL           string   `json:"url"`
+}
+
+// NewShare is the body of a request to create a share.
+type NewShare struct {
+	Path         string `json:"path"`
+	Mode         string `json:"mode"`      // "read" if empty
+	ExpiresIn    int    `json:"expiresIn"` // seconds, a week if 0
+	Password     string `json:"password"`
+	MaxDownloads int    `json:"maxDownloads"`
+	// upload shares only
+	MaxBytes     int64    `json:"maxBytes"`
+	MaxFiles     int      `json:"maxFiles"`
+	AllowedTypes []string `json:"allowedTypes"` // mime types, or prefixes like "image/*"
+}
+
+// ShareStore holds every share that hasn't expired or been revoked, and the
+// key share tokens are signed with. Both are kept in the data directory so
+// links keep working across restarts.
+type ShareStore struct {
+	lock   sync.RWMutex
+	shares map[string]Share
+	key    []byte
+	file   string
+}
+
+var shareStore = &ShareStore{shares: map[string]Share{}}
+
+const shareFileName = "shares.json"
+const shareKeyFileName = "share.key"
+
+// Load reads the shares saved in dataPath, and the signing key, creating the
+// key if there isn't one yet.
+func (s *ShareStore) Load(dataPath string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.file = filepath.Join(dataPath, shareFileName)
+
+	mkdirErr := os.MkdirAll(dataPath, 0777)
+	if mkdirErr != nil {
+		return fmt.Errorf("Error creating data directory: %s", mkdirErr.Error())
+	}
+	keyFile := filepath.Join(dataPath, shareKeyFileName)
+	key, keyErr := os.ReadFile(keyFile)
+	if os.IsNotExist(keyErr) {
+		key = make([]byte, 32)
+		if _, randErr := rand.Read(key); randErr != nil {
+			return fmt.Errorf("Error creating share key: %s", randErr.Error())
+		}
+		keyErr = os.WriteFile(keyFile, key, 0600)
+	}
+	if keyErr != nil {
+		return fmt.Errorf("Error reading share key: %s", keyErr.Error())
+	}
+	s.key = key
+
+	f, err := os.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading shares: %s", err.Error())
+	}
+	shares := map[string]Share{}
+	jsonErr := json.Unmarshal(f, &shares)
+	if jsonErr != nil {
+		return fmt.Errorf("Error reading shares: %s", jsonErr.Error())
+	}
+	s.shares = shares
+	return nil
+}
+
+// save writes the shares to disk. The lock must be held.
+func (s *ShareStore) save() error {
+	now := int(time.Now().Unix())
+	for id, share := range s.shares {
+		if share.Expires <= now {
+			delete(s.shares, id)
+		}
+	}
+	b, err := json.Marshal(s.shares)
+	if err != nil {
+		return fmt.Errorf("Error marshalling shares: %s", err.Error())
+	}
+	tmp := s.file + ".tmp"
+	writeErr := os.WriteFile(tmp, b, 0600)
+	if writeErr != nil {
+		return fmt.Errorf("Error saving shares: %s", writeErr.Error())
+	}
+	renameErr := os.Rename(tmp, s.file)
+	if renameErr != nil {
+		return fmt.Errorf("Error saving shares: %s", renameErr.Error())
+	}
+	return nil
+}
+
+// token is the part of a share's link that identifies it: its ID and an HMAC
+// of the ID, so links can't be made up without the key.
+func (s *ShareStore) token(id string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *ShareStore) info(share Share) ShareInfo {
+	token := s.token(share.ID)
+	url := "/_s/" + token + "/"
+	// a file is linked by name so the HLS files of a shared video resolve next to it
+	if share.Type == "file" {
+		url += path.Base(share.Path)
+	}
+	return ShareInfo{ID: share.ID, Path: share.Path, Type: share.Type, Mode: share.Mode, Created: share.Created, Expires: share.Expires, MaxDownloads: share.MaxDownloads, Downloads: share.Downloads, MaxBytes: share.MaxBytes, MaxFiles: share.MaxFiles, AllowedTypes: share.AllowedTypes, UploadedBytes: share.UploadedBytes, UploadedFiles: share.UploadedFiles, Password: share.PasswordHash != "", Token: token, URL: url}
+}
+
+func hashSharePassword(password string, salt []byte) (string, error) {
+	hash, err := pbkdf2.Key(sha256.New, password, salt, sharePasswordIterations, 32)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash), nil
+}
+
+// Open checks token and password against the shares, returning the share they
+// give access to.
+func (s *ShareStore) Open(token string, password string) (Share, error) {
+	id, _, _ := strings.Cut(token, ".")
+	s.lock.RLock()
+	expected := s.token(id)
+	share, ok := s.shares[id]
+	s.lock.RUnlock()
+	if !hmac.Equal([]byte(token), []byte(expected)) || !ok {
+		return Share{}, newError(codeNotFound, "Share not found")
+	}
+	if share.Expires <= int(time.Now().Unix()) {
+		return Share{}, newError(codeGone, "Share has expired")
+	}
+	if share.PasswordHash != "" {
+		salt, _ := hex.DecodeString(share.PasswordSalt)
+		hash, err := hashSharePassword(password, salt)
+		if err != nil || subtle.ConstantTimeCompare([]byte(hash), []byte(share.PasswordHash)) != 1 {
+			return Share{}, newError(codeUnauthorized, "Share needs a password")
+		}
+	}
+	return share, nil
+}
+
+// CountDownload takes one download from a share's limit, failing if there are
+// none left. The limit is only checked here, so a video whose playlist has
+// been counted can carry on streaming after the last download is taken.
+func (s *ShareStore) CountDownload(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	share, ok := s.shares[id]
+	if !ok {
+		return newError(codeNotFound, "Share not found")
+	}
+	if share.MaxDownloads > 0 && share.Downloads >= share.MaxDownloads {
+		return newError(codeGone, "Share has reached its download limit")
+	}
+	share.Downloads++
+	s.shares[id] = share
+	return s.save()
+}
+
+// AcceptUploads checks a batch of files dropped into an upload share against
+// its allowed types and quotas, and counts them towards the quotas if they
+// fit. Types are detected from the files' first bytes, whatever their names
+// claim.
+func (s *ShareStore) AcceptUploads(id string, files []File) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	share, ok := s.shares[id]
+	if !ok {
+		return newError(codeNotFound, "Share not found")
+	}
+
+	size := int64(0)
+	for _, f := range files {
+		size += int64(len(f.Bytes))
+		if len(share.AllowedTypes) == 0 {
+			continue
+		}
+		detected := mimetype.Detect(f.Bytes)
+		allowed := slices.ContainsFunc(share.AllowedTypes, func(t string) bool {
+			if prefix, isPrefix := strings.CutSuffix(t, "*"); isPrefix {
+				return strings.HasPrefix(detected.String(), prefix)
+			}
+			return detected.Is(t)
+		})
+		if !allowed {
+			return newError(codeUnsupportedType, "%s is %s, which this folder doesn't accept", f.Name, detected.String())
+		}
+	}
+	if share.MaxFiles > 0 && share.UploadedFiles+len(files) > share.MaxFiles {
+		return newError(codeQuotaExceeded, "Folder only accepts %d more files", share.MaxFiles-share.UploadedFiles)
+	}
+	if share.MaxBytes > 0 && share.UploadedBytes+size > share.MaxBytes {
+		return newError(codeQuotaExceeded, "Folder only accepts %d more bytes", share.MaxBytes-share.UploadedBytes)
+	}
+
+	share.UploadedFiles += len(files)
+	share.UploadedBytes += size
+	s.shares[id] = share
+	return s.save()
+}
+
+// CreateShare reads a NewShare from body and creates it, sending the new
+// ShareInfo as JSON.
+func CreateShare(ctx context.Context, basePaths map[string]string, body io.ReadCloser, c chan<- string, cErr chan<- error) {
+	defer close(cErr)
+	defer close(c)
+
+	req := NewShare{}
+	jsonErr := json.NewDecoder(body).Decode(&req)
+	body.Close()
+	if jsonErr != nil {
+		cErr <- newError(codeBadRequest, "Error parsing share: %s", jsonErr.Error())
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = shareRead
+	}
+	if req.Mode != shareRead && req.Mode != shareUpload {
+		cErr <- newError(codeBadRequest, "Unknown share mode %s", req.Mode)
+		return
+	}
+	if req.ExpiresIn < 0 || req.MaxDownloads < 0 || req.MaxBytes < 0 || req.MaxFiles < 0 {
+		cErr <- newError(codeBadRequest, "Expiry and limits can't be negative")
+		return
+	}
+	if req.Mode != shareUpload && (req.MaxBytes > 0 || req.MaxFiles > 0 || len(req.AllowedTypes) > 0) {
+		cErr <- newError(codeBadRequest, "Upload quotas and types only apply to %s shares", shareUpload)
+		return
+	}
+	expiresIn := defaultShareExpiry
+	if req.ExpiresIn > 0 {
+		expiresIn = time.Duration(req.ExpiresIn) * time.Second
+	}
+
+	virtualPath := path.Clean("/" + req.Path)
+	_, rootPath, fullPath, resolveErr := resolveVirtualPath(basePaths, virtualPath)
+	if resolveErr != nil {
+		cErr <- resolveErr
+		return
+	}
+	auditPaths(ctx, virtualPath, fullPath)
+	if fullPath == rootPath {
+		cErr <- newError(codeBadRequest, "A whole root can't be shared")
+		return
+	}
+	info, statErr := os.Stat(fullPath)
+	if statErr != nil {
+		cErr <- fmt.Errorf("Error reading file or directory: %w", statErr)
+		return
+	}
+	if req.Mode == shareUpload && !info.IsDir() {
+		cErr <- newError(codeBadRequest, "%s is not a directory", virtualPath)
+		return
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		cErr <- fmt.Errorf("Error creating share: %s", err.Error())
+		return
+	}
+	now := time.Now()
+	share := Share{ID: hex.EncodeToString(idBytes), Path: virtualPath, Type: "file", Mode: req.Mode, Created: int(now.Unix()), Expires: int(now.Add(expiresIn).Unix()), MaxDownloads: req.MaxDownloads, MaxBytes: req.MaxBytes, MaxFiles: req.MaxFiles, AllowedTypes: req.AllowedTypes}
+	if info.IsDir() {
+		share.Type = "directory"
+	}
+	if req.Password != "" {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			cErr <- fmt.Errorf("Error creating share: %s", err.Error())
+			return
+		}
+		hash, hashErr := hashSharePassword(req.Password, salt)
+		if hashErr != nil {
+			cErr <- fmt.Errorf("Error creating share: %s", hashErr.Error())
+			return
+		}
+		share.PasswordSalt = hex.EncodeToString(salt)
+		share.PasswordHash = hash
+	}
+
+	shareStore.lock.Lock()
+	shareStore.shares[share.ID] = share
+	saveErr := shareStore.save()
+	created := shareStore.info(share)
+	shareStore.lock.Unlock()
+	if saveErr != nil {
+		cErr <- saveErr
+		return
+	}
+	auditDetail(ctx, fmt.Sprintf("share %s, %s", share.ID, share.Mode))
+	s, err := json.Marshal(created)
+	if err != nil {
+		cErr <- fmt.Errorf("Error marshalling share: %s", err.Error())
+		return
+	}
+	c <- string(s)
+}
+
+// ListShares sends every share that is still usable as a JSON array, newest
+// first.
+func ListShares(c chan<- string, cErr chan<- error) {
+	defer close(cErr)
+	defer close(c)
+
+	now := int(time.Now().Unix())
+	shareStore.lock.RLock()
+	list := []ShareInfo{}
+	for _, share := range shareStore.shares {
+		if share.Expires <= now || (share.MaxDownloads > 0 && share.Downloads >= share.MaxDownloads) {
+			continue
+		}
+		list = append(list, shareStore.info(share))
+	}
+	shareStore.lock.RUnlock()
+	slices.SortFunc(list, func(a, b ShareInfo) int { return b.Created - a.Created })
+
+	s, err := json.Marshal(list)
+	if err != nil {
+		cErr <- fmt.Errorf("Error marshalling shares: %s", err.Error())
+		return
+	}
+	c <- string(s)
+}
+
+// RevokeShare deletes a share, so its link stops working straight away.
+func RevokeShare(ctx context.Context, id string, cErr chan<- error) {
+	defer close(cErr)
+
+	shareStore.lock.Lock()
+	defer shareStore.lock.Unlock()
+	share, ok := shareStore.shares[id]
+	if !ok {
+		cErr <- newError(codeNotFound, "Share %s not found", id)
+		return
+	}
+	auditPaths(ctx, share.Path, "")
+	delete(shareStore.shares, id)
+	saveErr := shareStore.save()
+	if saveErr != nil {
+		cErr <- saveErr
+	}
+}
+
+// countsAsDownload reports whether serving the file at fullPath through share
+// takes one of its downloads. That is the shared file itself, or any file in a
+// shared directory, but never the HLS output streamed for a video, which is
+// fetched piece by piece as it plays.
+func countsAsDownload(share Share, virtualPath string, fullPath string, streamablePath string) bool {
+	if share.Type != "directory" {
+		return virtualPath == share.Path
+	}
+	return streamablePath == "" || !strings.HasPrefix(fullPath, filepath.Clean(streamablePath)+"/")
+}
+
+// resolveSharePath maps the path asked for through a share onto a virtual
+// path, which has to stay inside what was shared. A shared file is reached by
+// its name, alongside the HLS files streamed for it if it is a video.
+func resolveSharePath(share Share, sharedIsDir bool, subPath string, streamablePath string) (string, error) {
+	subPath = strings.Trim(path.Clean("/"+subPath), "/")
+	if sharedIsDir {
+		if subPath == "" {
+			return share.Path, nil
+		}
+		return share.Path + "/" + subPath, nil
+	}
+	name, sanitisedFileName, virtualPathPrefix := streaming.GetStreamStrings(share.Path)
+	if subPath == "" || subPath == name {
+		return share.Path, nil
+	}
+	// only files that really are HLS output, so nothing else next to the
+	// shared file can be reached by a name that looks like it
+	if streamablePath != "" && !strings.Contains(subPath, "/") && strings.HasPrefix(subPath, sanitisedFileName) {
+		if info, err := os.Stat(streamablePath + virtualPathPrefix + "/" + subPath); err == nil && info.Mode().IsRegular() {
+			return virtualPathPrefix + "/" + subPath, nil
+		}
+	}
+	return "", newError(codeNotFound, "Path %s not found!", subPath)
+}
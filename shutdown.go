@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// shuttingDown is closed once rnas starts shutting down, to end requests that
+// would otherwise never finish, like change feeds.
+var shuttingDown = make(chan struct{})
+
+// Shutdown stops servers from taking new connections and gives the requests
+// and transcodes in progress until the shutdown timeout to finish. Whatever
+// is left after that is cut off, and the indexes are saved.
+func Shutdown(servers []*http.Server) {
+	timeout := time.Duration(getSettings().Config.ShutdownTimeoutSeconds) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	serverLog.Info("shutting down, waiting for requests and transcodes to finish", "timeout", timeout)
+	close(shuttingDown)
+
+	// transcodes are stopped alongside the servers rather than after them, so
+	// the two share the timeout instead of each getting all of it
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		StopTranscodes(ctx)
+	}()
+	for _, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := server.Shutdown(ctx)
+			if err != nil {
+				serverLog.Warn("error draining connections, closing them", "address", server.Addr, "error", err)
+				server.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	saveIndexes()
+	auditLog.Close()
+	serverLog.Info("shut down")
+}
@@ -1,13 +1,24 @@
 package streaming
 
 import (
+	"context"
 	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// Log is where the streaming package logs. rnas points it at its own logger.
+var Log = slog.Default()
+
 type FFMpegOutput struct {
 	IsSource     bool
 	Width        int
@@ -15,11 +26,33 @@ type FFMpegOutput struct {
 	AudioBitrate int
 }
 
+// Encoder is how every output is encoded.
+type Encoder struct {
+	Codec  string
+	Preset string
+	CRF    int
+}
+
 var p1080 = FFMpegOutput{Width: 1920, Height: 1080, AudioBitrate: 256, IsSource: false}
 var p720 = FFMpegOutput{Width: 1280, Height: 720, AudioBitrate: 192, IsSource: false}
 var p360 = FFMpegOutput{Width: 640, Height: 360, AudioBitrate: 128, IsSource: false}
 
+var configLock = sync.RWMutex{}
+var outputs = []FFMpegOutput{p1080, p720, p360}
+var encoder = Encoder{Codec: "libx265", Preset: "medium", CRF: 23}
+
+// Configure sets the sizes videos are transcoded to besides their own, and how
+// they are encoded.
+func Configure(o []FFMpegOutput, e Encoder) {
+	configLock.Lock()
+	defer configLock.Unlock()
+	outputs = o
+	encoder = e
+}
+
 func getFFMpegArgs(width int, height int) (filterComplex, videoMap, audioMap, buffMap []string) {
+	configLock.RLock()
+	defer configLock.RUnlock()
 	source := FFMpegOutput{Width: width, Height: height, AudioBitrate: 320, IsSource: true}
 	filterComplex = []string{}
 	videoMap = []string{}
@@ -28,12 +61,12 @@ func getFFMpegArgs(width int, height int) (filterComplex, videoMap, audioMap, bu
 	filterComplexOut := ""
 	idx := 0
 
-	allOutputs := []FFMpegOutput{source, p1080, p720, p360}
+	allOutputs := slices.Concat([]FFMpegOutput{source}, outputs)
 	for _, o := range allOutputs {
 		if o.IsSource || o.Width < source.Width || o.Height < source.Height {
 			filterComplexOut = filterComplexOut + fmt.Sprintf("[v%v]", idx)
 			filterComplex = append(filterComplex, fmt.Sprintf("[v%v]scale=w=%v:h=%v[v%vout]", idx, o.Width, o.Height, idx))
-			videoMap = append(videoMap, strings.Split(fmt.Sprintf("-map [v%vout] -c:v:%v libx265 -preset medium -crf 23 -g 60", idx, idx), " ")...)
+			videoMap = append(videoMap, strings.Split(fmt.Sprintf("-map [v%vout] -c:v:%v %s -preset %s -crf %v -g 60", idx, idx, encoder.Codec, encoder.Preset, encoder.CRF), " ")...)
 			audioMap = append(audioMap, strings.Split(fmt.Sprintf("-map a:0 -c:a:%v aac -b:a:%v %vk", idx, idx, o.AudioBitrate), " ")...)
 			buffMap = append(buffMap, fmt.Sprintf("v:%v,a:%v", idx, idx))
 			idx++
@@ -45,11 +78,77 @@ func getFFMpegArgs(width int, height int) (filterComplex, videoMap, audioMap, bu
 	return
 }
 
-func RunFfmpeg(fileName string, path string, outputPath string) error {
+// PartialMarker is the file that sits next to a transcode's output while ffmpeg
+// writes it. If it is there when ffmpeg isn't running, the output was cut
+// short and can't be served.
+func PartialMarker(fileName string, outputPath string) string {
+	return fmt.Sprintf("%s%s.partial", outputPath, fileName)
+}
+
+// variantOutput matches what is left of the name of a variant's playlist or
+// segment once the file name is taken off the front, as RunFfmpeg names them.
+// Variants are numbered with a single digit, so the output of a video whose
+// name is this one's with digits on the end, like movie2 for movie, never
+// matches.
+var variantOutput = regexp.MustCompile(`^[0-9]-(playlist\.m3u8|[0-9]{3,}\.ts)$`)
+
+// isTranscodeOutput reports whether name is one of the files the transcode of
+// fileName writes.
+func isTranscodeOutput(name string, fileName string) bool {
+	rest, ok := strings.CutPrefix(name, fileName)
+	return ok && (rest == ".m3u8" || rest == ".partial" || variantOutput.MatchString(rest))
+}
+
+// DiscardPartial removes everything the transcode of fileName left in
+// outputPath, marker included, so it can be run again.
+func DiscardPartial(fileName string, outputPath string) error {
+	dir, err := os.ReadDir(outputPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dir {
+		if !entry.IsDir() && isTranscodeOutput(entry.Name(), fileName) {
+			removeErr := os.Remove(outputPath + entry.Name())
+			if removeErr != nil {
+				return removeErr
+			}
+		}
+	}
+	return nil
+}
+
+// DiscardPartials finds every transcode under streamablePath that was cut
+// short and discards it. It returns how many there were.
+func DiscardPartials(streamablePath string) (int, error) {
+	count := 0
+	err := filepath.WalkDir(streamablePath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.HasSuffix(entry.Name(), ".partial") {
+			return err
+		}
+		discardErr := DiscardPartial(strings.TrimSuffix(entry.Name(), ".partial"), filepath.Dir(path)+"/")
+		if discardErr != nil {
+			return discardErr
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// RunFfmpeg transcodes the video at path into outputPath. If ctx is cancelled,
+// ffmpeg is asked to stop and killed if it doesn't, and the output is left
+// marked as partial.
+func RunFfmpeg(ctx context.Context, fileName string, path string, outputPath string) error {
+	marker := PartialMarker(fileName, outputPath)
+	markerErr := os.WriteFile(marker, []byte{}, 0666)
+	if markerErr != nil {
+		return markerErr
+	}
+
 	dimensionsArgs := []string{"-v", "error", "-select_streams", "v:0", "-show_entries", "stream=width,height", "-of", "csv=p=0", path}
-	dimensions := exec.Command("ffprobe", dimensionsArgs...)
+	dimensions := exec.CommandContext(ctx, "ffprobe", dimensionsArgs...)
 	dimensionsOut, dimensionsErr := dimensions.Output()
-	fmt.Println(fmt.Sprintf("dimensions input: %s", dimensions.String()))
+	Log.DebugContext(ctx, "probed dimensions", "command", dimensions.String())
 	var maxWidth string
 	var maxHeight string
 	if dimensionsErr != nil {
@@ -67,17 +166,26 @@ func RunFfmpeg(fileName string, path string, outputPath string) error {
 	if hErr != nil {
 		return hErr
 	}
-	fmt.Println("dimensions:", maxWidth, maxHeight)
+	Log.DebugContext(ctx, "dimensions", "width", width, "height", height)
 
 	filterComplex, videoMap, audioMap, buffMap := getFFMpegArgs(width, height)
 	transcodeArgs := slices.Concat([]string{"-i", path, "-filter_complex", fmt.Sprintf("%v", strings.Join(filterComplex, "; "))}, videoMap, audioMap, []string{"-hls_list_size", "0", "-f", "hls", "-hls_time", "10", "-hls_playlist_type", "vod", "-hls_flags", "independent_segments", "-hls_segment_type", "mpegts", "-hls_segment_filename", fmt.Sprintf("%s%s%s", outputPath, fileName, "%v-%03d.ts"), "-master_pl_name", fmt.Sprintf("%s.%s", fileName, "m3u8"), "-var_stream_map", fmt.Sprintf("%v", strings.Join(buffMap, " "))}, []string{fmt.Sprintf("%s%s%s", outputPath, fileName, "%v-playlist.m3u8")})
-	transcode := exec.Command("ffmpeg", transcodeArgs...)
+	transcode := exec.CommandContext(ctx, "ffmpeg", transcodeArgs...)
+	// ffmpeg stops cleanly on an interrupt, closing the files it is writing
+	transcode.Cancel = func() error {
+		return transcode.Process.Signal(os.Interrupt)
+	}
+	transcode.WaitDelay = 10 * time.Second
 
-	fmt.Println(fmt.Sprintf("ffmpeg input: %s", transcode.String()))
+	Log.InfoContext(ctx, "transcoding", "path", path)
+	Log.DebugContext(ctx, "running ffmpeg", "command", transcode.String())
 	transcodeOut, transcodeErr := transcode.Output()
+	if ctx.Err() != nil {
+		return fmt.Errorf("Error running ffmpeg: stopped part way through")
+	}
 	if transcodeErr != nil {
-		return fmt.Errorf("Error running ffmpeg: %s", transcodeErr.Error())
+		return fmt.Errorf("Error running ffmpeg: %w", transcodeErr)
 	}
-	fmt.Println(fmt.Sprintf("ffmpeg output: %s", string(transcodeOut)))
-	return nil
+	Log.DebugContext(ctx, "ffmpeg finished", "output", string(transcodeOut))
+	return os.Remove(marker)
 }
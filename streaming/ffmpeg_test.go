@@ -0,0 +1,32 @@
+package streaming
+
+import "testing"
+
+func TestIsTranscodeOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"movie-mkv.m3u8", true},
+		{"movie-mkv.partial", true},
+		{"movie-mkv0-playlist.m3u8", true},
+		{"movie-mkv8-000.ts", true},
+		{"movie-mkv0-1234.ts", true},
+		{"movie-mkv", false},
+		{"movie-mkv.ts", false},
+		{"movie-mkv0-12.ts", false},
+		{"movie-mkv10-playlist.m3u8", false},
+		{"movie-mkv2.m3u8", false},
+		{"movie-mkv2.partial", false},
+		{"movie-mkv20-000.ts", false},
+		{"movie-mkv0-playlist.m3u8.bak", false},
+		{"other-mkv.m3u8", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTranscodeOutput(tt.name, "movie-mkv"); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
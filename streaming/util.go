@@ -1,6 +1,7 @@
 package streaming
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strings"
@@ -14,8 +15,7 @@ func GetStreamStrings(virtualPath string) (fileName string, sanitisedFileName st
 	return
 }
 
-func GetStreamablePath(fileName string, pathPrefix string, streamablePath string) (*string, error) {
-	fmt.Println("filename:", fileName)
+func GetStreamablePath(ctx context.Context, fileName string, pathPrefix string, streamablePath string) (*string, error) {
 	dir, err := os.ReadDir(streamablePath)
 	if err != nil {
 		return nil, err
@@ -24,8 +24,7 @@ func GetStreamablePath(fileName string, pathPrefix string, streamablePath string
 		dirname := subdir.Name()
 		isDir := subdir.IsDir()
 		if isDir && strings.Contains(pathPrefix, dirname) {
-			fmt.Println("going deeper:", dirname)
-			found, findErr := GetStreamablePath(fileName, pathPrefix, fmt.Sprintf("%s/%s", streamablePath, dirname))
+			found, findErr := GetStreamablePath(ctx, fileName, pathPrefix, fmt.Sprintf("%s/%s", streamablePath, dirname))
 			if findErr != nil {
 				return nil, findErr
 			}
@@ -33,9 +32,8 @@ func GetStreamablePath(fileName string, pathPrefix string, streamablePath string
 				return found, nil
 			}
 		}
-		fmt.Println("dirname:", dirname)
 		if !isDir && (fileName == dirname || strings.HasPrefix(dirname, fileName)) {
-			fmt.Println("found", fileName, dirname)
+			Log.DebugContext(ctx, "found streaming file", "file", fileName, "dir", streamablePath)
 			return &streamablePath, nil
 		}
 	}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"rnas/streaming"
+	"strings"
+	"sync"
+	"time"
+)
+
+const transcodeFileName = "transcodes.json"
+
+// Transcode states. A transcode is queued until a slot is free to run it,
+// and failed ones are tried again once their backoff has passed.
+const (
+	transcodeQueued  = "queued"
+	transcodeRunning = "running"
+	transcodeDone    = "done"
+	transcodeFailed  = "failed"
+)
+
+// maxTranscodes is how many ffmpeg runs can happen at once.
+const maxTranscodes = 1
+
+const transcodeRetryMin = time.Minute
+const transcodeRetryMax = 24 * time.Hour
+
+type Transcode struct {
+	Source         string `json:"source"` // the video, as a real path
+	SourceModified int64  `json:"sourceModified"`
+	OutputPath     string `json:"outputPath"` // the directory the HLS files go in
+	FileName       string `json:"fileName"`   // what the HLS files are named after
+	State          string `json:"state"`
+	Failures       int    `json:"failures"`
+	Error          string `json:"error,omitempty"`
+	RetryAt        int64  `json:"retryAt,omitempty"` // unix time, once failed
+	Updated        int64  `json:"updated"`
+}
+
+func (t Transcode) playlist() string {
+	return fmt.Sprintf("%s%s.m3u8", t.OutputPath, t.FileName)
+}
+
+// TranscodeStore keeps the state of every transcode on disk, keyed by its
+// playlist, so a crash can't leave a video looking transcoded or stuck
+// transcoding.
+type TranscodeStore struct {
+	lock       sync.Mutex
+	changed    *sync.Cond // broadcast whenever a transcode finishes
+	transcodes map[string]*Transcode
+	active     map[string]bool // transcodes queued or running in this process
+	slots      chan struct{}
+	file       string
+}
+
+var transcodeStore = newTranscodeStore()
+
+func newTranscodeStore() *TranscodeStore {
+	s := &TranscodeStore{transcodes: map[string]*Transcode{}, active: map[string]bool{}, slots: make(chan struct{}, maxTranscodes)}
+	s.changed = sync.NewCond(&s.lock)
+	return s
+}
+
+// Load reads the transcode states from dataPath and reconciles them with what
+// is in streamablePath. Transcodes that were cut short have their output
+// discarded and are queued again, and ones whose video or output has gone are
+// forgotten.
+func (s *TranscodeStore) Load(dataPath string, streamablePath string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.file = filepath.Join(dataPath, transcodeFileName)
+
+	mkdirErr := os.MkdirAll(dataPath, 0777)
+	if mkdirErr != nil {
+		return fmt.Errorf("Error creating data directory: %s", mkdirErr.Error())
+	}
+	f, err := os.ReadFile(s.file)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error reading transcodes: %s", err.Error())
+	}
+	if err == nil {
+		transcodes := map[string]*Transcode{}
+		unmarshalErr := json.Unmarshal(f, &transcodes)
+		if unmarshalErr != nil {
+			return fmt.Errorf("Error reading transcodes: %s", unmarshalErr.Error())
+		}
+		s.transcodes = transcodes
+	}
+
+	// nothing is running yet, so any partial output is from a run that was
+	// cut short
+	if streamablePath != "" {
+		discarded, discardErr := streaming.DiscardPartials(streamablePath)
+		if discardErr != nil {
+			streamingLog.Error("error discarding partial transcodes", "error", discardErr)
+		} else if discarded > 0 {
+			streamingLog.Info("discarded partial transcodes", "count", discarded)
+		}
+	}
+
+	resume := []string{}
+	for key, t := range s.transcodes {
+		if _, statErr := os.Stat(t.Source); statErr != nil {
+			delete(s.transcodes, key)
+			continue
+		}
+		switch t.State {
+		case transcodeQueued, transcodeRunning:
+			t.State = transcodeQueued
+			resume = append(resume, key)
+		case transcodeDone:
+			if _, statErr := os.Stat(t.playlist()); statErr != nil {
+				delete(s.transcodes, key)
+			}
+		}
+	}
+	for _, key := range resume {
+		streamingLog.Info("resuming transcode", "path", s.transcodes[key].Source)
+		s.start(context.Background(), key)
+	}
+	return s.save()
+}
+
+// save writes the transcode states to disk. It is called with the lock held.
+func (s *TranscodeStore) save() error {
+	if s.file == "" {
+		return nil
+	}
+	b, err := json.Marshal(s.transcodes)
+	if err != nil {
+		return fmt.Errorf("Error marshalling transcodes: %s", err.Error())
+	}
+	tmp := s.file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("Error saving transcodes: %s", err.Error())
+	}
+	_, writeErr := f.Write(b)
+	if writeErr == nil {
+		// synced before the rename, so a crash leaves the old states or the
+		// new ones but never a torn file
+		writeErr = f.Sync()
+	}
+	closeErr := f.Close()
+	if writeErr != nil || closeErr != nil {
+		return fmt.Errorf("Error saving transcodes: %s", errors.Join(writeErr, closeErr).Error())
+	}
+	renameErr := os.Rename(tmp, s.file)
+	if renameErr != nil {
+		return fmt.Errorf("Error saving transcodes: %s", renameErr.Error())
+	}
+	return nil
+}
+
+// setState records a transcode's new state. It is called with the lock held.
+func (s *TranscodeStore) setState(key string, state string) {
+	t := s.transcodes[key]
+	t.State = state
+	t.Updated = time.Now().Unix()
+	saveErr := s.save()
+	if saveErr != nil {
+		streamingLog.Error("error saving transcodes", "error", saveErr)
+	}
+}
+
+// start queues a transcode to run in the background, logging as part of the
+// request in ctx. It is called with the lock held.
+func (s *TranscodeStore) start(ctx context.Context, key string) {
+	s.active[key] = true
+	s.setState(key, transcodeQueued)
+	go s.run(requestIDOf(ctx), key)
+}
+
+// count returns how many transcodes in this process are in state.
+func (s *TranscodeStore) count(state string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := 0
+	for key := range s.active {
+		if s.transcodes[key].State == state {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *TranscodeStore) run(requestID string, key string) {
+	s.slots <- struct{}{}
+	defer func() { <-s.slots }()
+
+	s.lock.Lock()
+	t := *s.transcodes[key]
+	s.setState(key, transcodeRunning)
+	s.lock.Unlock()
+	started := time.Now()
+
+	// whatever an earlier run left behind is cleared out first, as ffmpeg
+	// won't write over it
+	err := streaming.DiscardPartial(t.FileName, t.OutputPath)
+	if err == nil {
+		err = runTranscode(requestID, t.FileName, t.Source, t.OutputPath)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.active, key)
+	defer s.changed.Broadcast()
+	switch {
+	case errors.Is(err, errTranscodeStopped):
+		// left queued, to be resumed on the next start
+		s.setState(key, transcodeQueued)
+	case err != nil:
+		transcodeDuration.WithLabelValues(transcodeFailed).Observe(time.Since(started).Seconds())
+		transcodeFailures.WithLabelValues(transcodeFailureReason(err)).Inc()
+		tp := s.transcodes[key]
+		tp.Failures++
+		tp.Error = err.Error()
+		backoff := min(transcodeRetryMin<<(tp.Failures-1), transcodeRetryMax)
+		tp.RetryAt = time.Now().Add(backoff).Unix()
+		streamingLog.ErrorContext(withRequestID(context.Background(), requestID), "error transcoding", "path", t.Source, "failures", tp.Failures, "retry_in", backoff, "error", err)
+		s.setState(key, transcodeFailed)
+	default:
+		transcodeDuration.WithLabelValues(transcodeDone).Observe(time.Since(started).Seconds())
+		tp := s.transcodes[key]
+		tp.Failures, tp.Error, tp.RetryAt = 0, "", 0
+		s.setState(key, transcodeDone)
+	}
+}
+
+// Wait transcodes the video at source into fileName in outputPath, unless
+// that has been done already, and waits for it to finish or for ctx to be
+// done.
+func (s *TranscodeStore) Wait(ctx context.Context, source string, outputPath string, fileName string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s%s.m3u8", outputPath, fileName)
+
+	// wake the loop below when the request goes away, so it stops waiting
+	// on a transcode it no longer wants
+	stop := context.AfterFunc(ctx, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.changed.Broadcast()
+	})
+	defer stop()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	hit := true
+	defer func() {
+		if hit {
+			streamCacheRequests.WithLabelValues("hit").Inc()
+		} else {
+			streamCacheRequests.WithLabelValues("miss").Inc()
+		}
+	}()
+	for {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if s.active[key] {
+			hit = false
+			s.changed.Wait()
+			continue
+		}
+		t, ok := s.transcodes[key]
+		if !ok || t.Source != source || t.SourceModified != info.ModTime().UnixNano() {
+			// a new or changed video starts again with a clean slate
+			t = &Transcode{Source: source, SourceModified: info.ModTime().UnixNano(), OutputPath: outputPath, FileName: fileName}
+			s.transcodes[key] = t
+			// output from before transcodes were tracked is whole, as
+			// partial output is discarded on startup
+			if _, statErr := os.Stat(key); !ok && statErr == nil {
+				s.setState(key, transcodeDone)
+			}
+		}
+		switch {
+		case t.State == transcodeDone:
+			if _, statErr := os.Stat(key); statErr == nil {
+				return nil
+			}
+			// the output has been removed since
+		case t.State == transcodeFailed && time.Now().Unix() < t.RetryAt:
+			return fmt.Errorf("Error transcoding: failed %d times, trying again after %s: %s", t.Failures, time.Unix(t.RetryAt, 0).Format(time.RFC3339), t.Error)
+		}
+		hit = false
+		if transcodesStopping() {
+			return errTranscodeStopped
+		}
+		s.start(ctx, key)
+	}
+}
+
+var errTranscodeStopped = errors.New("Error running ffmpeg: rnas is shutting down")
+
+// transcodesRunning counts the ffmpeg runs in progress, so shutdown can wait
+// for them. Once transcodesStopped is set no more are started.
+var transcodesLock = sync.Mutex{}
+var transcodesRunning = sync.WaitGroup{}
+var transcodesStopped = false
+var transcodesCtx, cancelTranscodes = context.WithCancel(context.Background())
+
+func transcodesStopping() bool {
+	transcodesLock.Lock()
+	defer transcodesLock.Unlock()
+	return transcodesStopped
+}
+
+func runTranscode(requestID string, fileName string, path string, outputPath string) error {
+	transcodesLock.Lock()
+	if transcodesStopped {
+		transcodesLock.Unlock()
+		return errTranscodeStopped
+	}
+	transcodesRunning.Add(1)
+	transcodesLock.Unlock()
+	defer transcodesRunning.Done()
+	// stopped by shutdown rather than by the request that started it, which
+	// may give up waiting before it finishes
+	err := streaming.RunFfmpeg(withRequestID(transcodesCtx, requestID), fileName, path, outputPath)
+	if err != nil && transcodesCtx.Err() != nil {
+		return errTranscodeStopped
+	}
+	return err
+}
+
+// StopTranscodes gives running transcodes until ctx is done to finish, then
+// stops the rest, which are resumed on the next start. No transcodes start
+// after it is called.
+func StopTranscodes(ctx context.Context) {
+	transcodesLock.Lock()
+	transcodesStopped = true
+	transcodesLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		transcodesRunning.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+	streamingLog.Warn("stopping running transcodes")
+	cancelTranscodes()
+	<-done
+}
+
+func getStreamFile(ctx context.Context, path string, virtualPath string, streamablePath string) (*os.File, os.FileInfo, error) {
+	parts := strings.Split(virtualPath, "/")
+	fileName := parts[len(parts)-1]
+	if fileName == "" {
+		return nil, nil, fmt.Errorf("filename could not be found at virtual path %s", virtualPath)
+	}
+	sanitisedFileName := strings.ReplaceAll(fileName, ".", "-")
+	outputPath := fmt.Sprintf("%s%s/", streamablePath, strings.Join(parts[:len(parts)-1], "/"))
+	outputFilePath := fmt.Sprintf("%s%s.%s", outputPath, sanitisedFileName, "m3u8")
+	mkdirErr := os.MkdirAll(outputPath, 0777)
+	if mkdirErr != nil {
+		return nil, nil, mkdirErr
+	}
+
+	transcodeErr := transcodeStore.Wait(ctx, path, outputPath, sanitisedFileName)
+	if transcodeErr != nil {
+		return nil, nil, transcodeErr
+	}
+	file, err := os.Open(outputFilePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, fileInfo, nil
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// trashDirName is the hidden directory at the top of every root that holds
+// trashed items. Like the freedesktop trash spec, the items themselves live in
+// "files" and their metadata lives alongside in "info".
+const trashDirName = ".rnas-trash"
+
+type TrashItem struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"` // "file" or "directory"
+	Root    string `json:"root"`
+	Name    string `json:"name"`
+	Path    string `json:"path"`    // original virtual path
+	Deleted int    `json:"deleted"` // unix time the item was trashed
+	Size    int    `json:"size"`
+}
+
+func trashFilesPath(rootPath string) string {
+	return filepath.Join(rootPath, trashDirName, "files")
+}
+
+func trashInfoPath(rootPath string) string {
+	return filepath.Join(rootPath, trashDirName, "info")
+}
+
+// Trash moves the file or directory at fullPath into the trash of the root at
+// rootPath, sending the resulting TrashItem as JSON on cItem. Non-empty
+// directories must be confirmed the same way as a recursive delete.
+func Trash(ctx context.Context, fullPath string, virtualPath string, rootName string, rootPath string, recursive bool, confirm string, cItem chan<- string, cErr chan<- error) {
+	defer close(cErr)
+	defer close(cItem)
+
+	info, statErr := os.Lstat(fullPath)
+	if statErr != nil {
+		cErr <- statErr
+		return
+	}
+	if filepath.Clean(fullPath) == filepath.Clean(rootPath) {
+		cErr <- newError(codeForbidden, "Cannot delete root %s", rootName)
+		return
+	}
+
+	item := TrashItem{Type: "file", Root: rootName, Name: info.Name(), Path: virtualPath, Deleted: int(time.Now().Unix()), Size: int(info.Size())}
+	if info.IsDir() {
+		item.Type = "directory"
+		entries, err := os.ReadDir(fullPath)
+		if err != nil {
+			cErr <- err
+			return
+		}
+		if len(entries) > 0 && (!recursive || confirm != info.Name()) {
+			cErr <- newError(codeBadRequest, "Directory %s is not empty, delete must be confirmed with recursive=true&confirm=%s", virtualPath, info.Name())
+			return
+		}
+		item.Size = int(getTreeSize(fullPath))
+	}
+
+	id, idErr := newTrashID()
+	if idErr != nil {
+		cErr <- idErr
+		return
+	}
+	item.ID = id
+
+	for _, dir := range []string{trashFilesPath(rootPath), trashInfoPath(rootPath)} {
+		mkdirErr := os.MkdirAll(dir, 0777)
+		if mkdirErr != nil {
+			cErr <- mkdirErr
+			return
+		}
+	}
+
+	s, err := json.Marshal(item)
+	if err != nil {
+		cErr <- fmt.Errorf("Error marshalling trash info: %s", err.Error())
+		return
+	}
+	// the info file is written first so a crash part way through never leaves
+	// an item in the trash that can't be restored
+	infoFile := filepath.Join(trashInfoPath(rootPath), id+".json")
+	writeErr := os.WriteFile(infoFile, s, 0666)
+	if writeErr != nil {
+		cErr <- writeErr
+		return
+	}
+	renameErr := os.Rename(fullPath, filepath.Join(trashFilesPath(rootPath), id))
+	if renameErr != nil {
+		os.Remove(infoFile)
+		cErr <- renameErr
+		return
+	}
+	quotas.Moved(fullPath, filepath.Join(trashFilesPath(rootPath), id))
+	auditBytes(ctx, int64(item.Size))
+	notifyRemoved(fullPath, info.IsDir())
+
+	cItem <- string(s)
+	trashLog.InfoContext(ctx, "trashed", "path", fullPath, "id", id)
+}
+
+// ListTrash sends a JSON array of the trashed items for every root in
+// basePaths, or only for rootName if it is set.
+func ListTrash(basePaths map[string]string, rootName string, c chan<- string, cErr chan<- error) {
+	defer close(cErr)
+	defer close(c)
+
+	if rootName != "" {
+		if _, ok := basePaths[rootName]; !ok {
+			cErr <- newError(codeNotFound, "Root %s not found", rootName)
+			return
+		}
+	}
+
+	items := []TrashItem{}
+	for name, path := range basePaths {
+		if rootName != "" && name != rootName {
+			continue
+		}
+		rootItems, err := getTrashItems(path)
+		if err != nil {
+			cErr <- err
+			return
+		}
+		items = append(items, rootItems...)
+	}
+
+	s, err := json.Marshal(items)
+	if err != nil {
+		cErr <- fmt.Errorf("Error marshalling trash items: %s", err.Error())
+		return
+	}
+	c <- string(s)
+}
+
+// RestoreTrash moves a trashed item back to its original path, recreating any
+// missing parent directories. It will not overwrite anything already there.
+func RestoreTrash(ctx context.Context, basePaths map[string]string, rootName string, id string, cErr chan<- error) {
+	defer close(cErr)
+
+	rootPath, item, err := getTrashItem(basePaths, rootName, id)
+	if err != nil {
+		cErr <- err
+		return
+	}
+
+	originalPath := filepath.Join(rootPath, strings.TrimPrefix(item.Path, "/"+rootName))
+	auditPaths(ctx, item.Path, originalPath)
+	_, statErr := os.Lstat(originalPath)
+	if statErr == nil {
+		cErr <- newError(codeConflict, "File with name %s already exists in directory", item.Name)
+		return
+	}
+	mkdirErr := os.MkdirAll(filepath.Dir(originalPath), 0777)
+	if mkdirErr != nil {
+		cErr <- mkdirErr
+		return
+	}
+	renameErr := os.Rename(filepath.Join(trashFilesPath(rootPath), id), originalPath)
+	if renameErr != nil {
+		cErr <- renameErr
+		return
+	}
+	quotas.Moved(filepath.Join(trashFilesPath(rootPath), id), originalPath)
+	auditBytes(ctx, int64(item.Size))
+	notifyChanged(changeCreate, originalPath)
+	removeErr := os.Remove(filepath.Join(trashInfoPath(rootPath), id+".json"))
+	if removeErr != nil {
+		cErr <- removeErr
+		return
+	}
+
+	trashLog.InfoContext(ctx, "restored", "path", originalPath, "id", id)
+}
+
+// PurgeTrash permanently removes a trashed item, or every item in the root's
+// trash if id is empty, along with any HLS output for videos inside it.
+func PurgeTrash(ctx context.Context, basePaths map[string]string, rootName string, id string, streamablePath string, cErr chan<- error) {
+	defer close(cErr)
+
+	if id != "" {
+		rootPath, item, err := getTrashItem(basePaths, rootName, id)
+		if err != nil {
+			cErr <- err
+			return
+		}
+		purgeErr := purgeTrashItem(rootPath, *item, streamablePath)
+		if purgeErr != nil {
+			cErr <- purgeErr
+			return
+		}
+		auditBytes(ctx, int64(item.Size))
+		return
+	}
+
+	rootPath, ok := basePaths[rootName]
+	if !ok {
+		cErr <- newError(codeNotFound, "Root %s not found", rootName)
+		return
+	}
+	items, err := getTrashItems(rootPath)
+	if err != nil {
+		cErr <- err
+		return
+	}
+	for _, item := range items {
+		purgeErr := purgeTrashItem(rootPath, item, streamablePath)
+		if purgeErr != nil {
+			cErr <- purgeErr
+			return
+		}
+		auditBytes(ctx, int64(item.Size))
+	}
+}
+
+// SweepTrash runs forever, purging items that have been in the trash for
+// longer than the configured retention. A zero retention disables sweeping.
+func SweepTrash(interval time.Duration) {
+	for ; ; time.Sleep(interval) {
+		settings := getSettings()
+		if settings.TrashRetention <= 0 {
+			continue
+		}
+		cutoff := time.Now().Add(-settings.TrashRetention).Unix()
+		for _, rootPath := range settings.BasePaths {
+			items, err := getTrashItems(rootPath)
+			if err != nil {
+				trashLog.Error("error sweeping trash", "error", err)
+				continue
+			}
+			for _, item := range items {
+				if int64(item.Deleted) > cutoff {
+					continue
+				}
+				trashLog.Info("sweeping trash item", "id", item.ID, "path", item.Path)
+				purgeErr := purgeTrashItem(rootPath, item, settings.StreamablePath)
+				if purgeErr != nil {
+					trashLog.Error("error sweeping trash", "error", purgeErr)
+				}
+			}
+		}
+	}
+}
+
+func purgeTrashItem(rootPath string, item TrashItem, streamablePath string) error {
+	itemPath := filepath.Join(trashFilesPath(rootPath), item.ID)
+	videos := []string{}
+	filepath.WalkDir(itemPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if mime, mimeErr := mimetype.DetectFile(p); mimeErr == nil && strings.HasPrefix(mime.String(), "video/") {
+			videos = append(videos, toVirtualPath(p, itemPath, item.Path))
+		}
+		return nil
+	})
+
+	usage := measureTree(itemPath)
+	removeErr := os.RemoveAll(itemPath)
+	if removeErr != nil {
+		return fmt.Errorf("Error purging trash item %s: %s", item.ID, removeErr.Error())
+	}
+	quotas.RemovedTree(itemPath, usage)
+	for _, video := range videos {
+		streamErr := deleteStreamFiles(context.Background(), video, streamablePath)
+		if streamErr != nil {
+			return streamErr
+		}
+	}
+	return os.Remove(filepath.Join(trashInfoPath(rootPath), item.ID+".json"))
+}
+
+func getTrashItem(basePaths map[string]string, rootName string, id string) (string, *TrashItem, error) {
+	rootPath, ok := basePaths[rootName]
+	if !ok {
+		return "", nil, newError(codeNotFound, "Root %s not found", rootName)
+	}
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return "", nil, newError(codeBadRequest, "Invalid trash item id %s", id)
+	}
+	s, err := os.ReadFile(filepath.Join(trashInfoPath(rootPath), id+".json"))
+	if err != nil {
+		return "", nil, fmt.Errorf("Error reading trash item %s: %w", id, err)
+	}
+	item := TrashItem{}
+	jsonErr := json.Unmarshal(s, &item)
+	if jsonErr != nil {
+		return "", nil, fmt.Errorf("Error reading trash item %s: %s", id, jsonErr.Error())
+	}
+	return rootPath, &item, nil
+}
+
+func getTrashItems(rootPath string) ([]TrashItem, error) {
+	infos, err := os.ReadDir(trashInfoPath(rootPath))
+	if os.IsNotExist(err) {
+		return []TrashItem{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading trash: %s", err.Error())
+	}
+	items := []TrashItem{}
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		s, readErr := os.ReadFile(filepath.Join(trashInfoPath(rootPath), info.Name()))
+		if readErr != nil {
+			trashLog.Error("error reading trash item", "id", info.Name(), "error", readErr)
+			continue
+		}
+		item := TrashItem{}
+		jsonErr := json.Unmarshal(s, &item)
+		if jsonErr != nil {
+			trashLog.Error("error reading trash item", "id", info.Name(), "error", jsonErr)
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func getTreeSize(path string) int64 {
+	size := int64(0)
+	filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, infoErr := d.Info(); infoErr == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+func newTrashID() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%s", time.Now().Unix(), hex.EncodeToString(b)), nil
+}
+
+// isHiddenEntry reports whether a directory entry is internal to rnas and
+// should be left out of listings.
+func isHiddenEntry(name string) bool {
+	return name == trashDirName || name == versionsDirName || strings.HasPrefix(name, uploadTempPrefix)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type DiskUsage struct {
+	Path        string               `json:"path"`
+	Size        int                  `json:"size"`
+	Files       int                  `json:"files"`
+	Directories int                  `json:"directories"`
+	Mime        map[string]MimeUsage `json:"mime"`
+}
+type MimeUsage struct {
+	Size  int `json:"size"`
+	Files int `json:"files"`
+}
+
+func (u *DiskUsage) add(other DiskUsage) {
+	u.Size += other.Size
+	u.Files += other.Files
+	u.Directories += other.Directories
+	for mime, usage := range other.Mime {
+		total := u.Mime[mime]
+		total.Size += usage.Size
+		total.Files += usage.Files
+		u.Mime[mime] = total
+	}
+}
+
+// dirUsageEntry caches the usage of the files directly inside one directory.
+// Totals are summed from these on every request, so a change only ever costs
+// re-reading the directory it happened in.
+type dirUsageEntry struct {
+	modified time.Time
+	own      DiskUsage
+	subdirs  []string
+}
+
+var dirUsageCacheLock = sync.RWMutex{}
+var dirUsageCache = map[string]dirUsageEntry{}
+
+// invalidateUsage drops the cached usage of the directory containing path, and
+// of path itself and everything below it if it is a directory. It should be
+// called after anything under a root is written or removed, since changing a
+// file in place doesn't touch its directory's modification time.
+func invalidateUsage(path string) {
+	path = filepath.Clean(path)
+	dirUsageCacheLock.Lock()
+	defer dirUsageCacheLock.Unlock()
+	delete(dirUsageCache, filepath.Dir(path))
+	delete(dirUsageCache, path)
+	prefix := path + string(filepath.Separator)
+	for cached := range dirUsageCache {
+		if strings.HasPrefix(cached, prefix) {
+			delete(dirUsageCache, cached)
+		}
+	}
+}
+
+// clearUsage empties the usage cache, so every directory is read again.
+func clearUsage() {
+	dirUsageCacheLock.Lock()
+	defer dirUsageCacheLock.Unlock()
+	dirUsageCache = map[string]dirUsageEntry{}
+}
+
+// getDiskUsage totals the directory at path and everything below it. A cached
+// directory is only re-read if its modification time has moved on.
+func getDiskUsage(path string) (DiskUsage, error) {
+	path = filepath.Clean(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return DiskUsage{}, fmt.Errorf("Error reading directory %s: %w", path, err)
+	}
+
+	dirUsageCacheLock.RLock()
+	entry, cached := dirUsageCache[path]
+	dirUsageCacheLock.RUnlock()
+	if !cached || !entry.modified.Equal(info.ModTime()) {
+		entry, err = readDirUsage(path, info.ModTime())
+		if err != nil {
+			return DiskUsage{}, err
+		}
+		dirUsageCacheLock.Lock()
+		dirUsageCache[path] = entry
+		dirUsageCacheLock.Unlock()
+	}
+
+	total := DiskUsage{Mime: map[string]MimeUsage{}}
+	total.add(entry.own)
+	for _, subdir := range entry.subdirs {
+		subUsage, subErr := getDiskUsage(filepath.Join(path, subdir))
+		if subErr != nil {
+			filesLog.Error("error reading disk usage", "error", subErr)
+			continue
+		}
+		total.add(subUsage)
+	}
+	return total, nil
+}
+
+func readDirUsage(path string, modified time.Time) (dirUsageEntry, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return dirUsageEntry{}, fmt.Errorf("Error reading directory %s: %w", path, err)
+	}
+	entry := dirUsageEntry{modified: modified, own: DiskUsage{Mime: map[string]MimeUsage{}}, subdirs: []string{}}
+	for _, dirEntry := range entries {
+		if isHiddenEntry(dirEntry.Name()) {
+			continue
+		}
+		if dirEntry.IsDir() {
+			entry.own.Directories++
+			entry.subdirs = append(entry.subdirs, dirEntry.Name())
+			continue
+		}
+		info, infoErr := dirEntry.Info()
+		if infoErr != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		mime, _, _ := strings.Cut(getMimeType(filepath.Join(path, dirEntry.Name()), info), ";")
+		entry.own.Size += int(info.Size())
+		entry.own.Files++
+		usage := entry.own.Mime[mime]
+		usage.Size += int(info.Size())
+		usage.Files++
+		entry.own.Mime[mime] = usage
+	}
+	return entry, nil
+}
+
+// ReadDiskUsage sends the DiskUsage of the directory at fullPath as JSON, or of
+// every root together if fullPath is empty.
+func ReadDiskUsage(fullPath string, virtualPath string, basePaths map[string]string, c chan<- string, cErr chan<- error) {
+	defer close(cErr)
+	defer close(c)
+
+	usage := DiskUsage{Mime: map[string]MimeUsage{}}
+	if fullPath == "" {
+		for _, rootPath := range basePaths {
+			rootUsage, err := getDiskUsage(rootPath)
+			if err != nil {
+				cErr <- err
+				return
+			}
+			usage.add(rootUsage)
+			usage.Directories++
+		}
+	} else {
+		info, statErr := os.Stat(fullPath)
+		if statErr != nil {
+			cErr <- fmt.Errorf("Error reading file or directory: %w", statErr)
+			return
+		}
+		if !info.IsDir() {
+			cErr <- newError(codeBadRequest, "%s is not a directory", virtualPath)
+			return
+		}
+		dirUsage, err := getDiskUsage(fullPath)
+		if err != nil {
+			cErr <- err
+			return
+		}
+		usage = dirUsage
+	}
+	usage.Path = virtualPath
+
+	s, err := json.Marshal(usage)
+	if err != nil {
+		cErr <- fmt.Errorf("Error marshalling disk usage: %s", err.Error())
+		return
+	}
+	c <- string(s)
+}
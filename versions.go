@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// versionsDirName is the hidden directory at the top of every root that keeps
+// the previous contents of overwritten files. Versions of a file live in a
+// directory mirroring the file's path, named by the time they were replaced.
+const versionsDirName = ".rnas-versions"
+
+type VersionRetention struct {
+	MaxCount int
+	MaxAge   time.Duration
+}
+
+type FileVersion struct {
+	ID        string `json:"id"`
+	Size      int    `json:"size"`
+	Modified  int    `json:"modified"`  // unix time the version was last written
+	Versioned int    `json:"versioned"` // unix time the version was replaced
+}
+
+func getVersionsPath(rootPath string, fullPath string) (string, error) {
+	rel, err := filepath.Rel(rootPath, fullPath)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", newError(codeBadRequest, "%s is not a file inside root %s", clientPath(fullPath), clientPath(rootPath))
+	}
+	return filepath.Join(rootPath, versionsDirName, rel), nil
+}
+
+// saveVersion keeps the current contents of the file at fullPath before it is
+// replaced. The version is a hard link where possible, so the old contents
+// survive the rename over the top of them without being copied.
+func saveVersion(rootPath string, fullPath string, retention VersionRetention) error {
+	info, statErr := os.Stat(fullPath)
+	if errors.Is(statErr, fs.ErrNotExist) {
+		return nil
+	}
+	if statErr != nil {
+		return statErr
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a file", clientPath(fullPath))
+	}
+
+	versionsPath, err := getVersionsPath(rootPath, fullPath)
+	if err != nil {
+		return err
+	}
+	mkdirErr := os.MkdirAll(versionsPath, 0777)
+	if mkdirErr != nil {
+		return mkdirErr
+	}
+	versionPath := filepath.Join(versionsPath, strconv.FormatInt(time.Now().UnixNano(), 10))
+	linkErr := os.Link(fullPath, versionPath)
+	if linkErr != nil {
+		copyErr := copyFile(fullPath, versionPath)
+		if copyErr != nil {
+			return fmt.Errorf("Error saving version of %s: %s", info.Name(), copyErr.Error())
+		}
+	}
+	os.Chtimes(versionPath, info.ModTime(), info.ModTime())
+	// the only place the old contents are counted from now on, as the file
+	// written over them is counted as replacing them
+	quotas.Added(versionPath, "", info.Size())
+
+	return pruneVersions(versionsPath, retention)
+}
+
+// pruneVersions drops the versions in versionsPath that are past the
+// retention's age, then the oldest until at most MaxCount remain.
+func pruneVersions(versionsPath string, retention VersionRetention) error {
+	versions, err := getVersions(versionsPath)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-retention.MaxAge).Unix()
+	for idx, version := range versions {
+		tooOld := retention.MaxAge > 0 && int64(version.Versioned) < cutoff
+		tooMany := retention.MaxCount > 0 && idx >= retention.MaxCount
+		if !tooOld && !tooMany {
+			continue
+		}
+		removeErr := os.Remove(filepath.Join(versionsPath, version.ID))
+		if removeErr != nil {
+			return fmt.Errorf("Error pruning version %s: %s", version.ID, removeErr.Error())
+		}
+		quotas.Removed(filepath.Join(versionsPath, version.ID), int64(version.Size))
+	}
+	// only succeeds once the last version is gone
+	os.Remove(versionsPath)
+	return nil
+}
+
+// getVersions returns the versions in versionsPath, newest first.
+func getVersions(versionsPath string) ([]FileVersion, error) {
+	entries, err := os.ReadDir(versionsPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []FileVersion{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading versions: %s", err.Error())
+	}
+	versions := []FileVersion{}
+	for _, entry := range entries {
+		versioned, parseErr := strconv.ParseInt(entry.Name(), 10, 64)
+		if parseErr != nil || entry.IsDir() {
+			continue
+		}
+		info, infoErr := entry.Info()
+		if infoErr != nil {
+			continue
+		}
+		versions = append(versions, FileVersion{ID: entry.Name(), Size: int(info.Size()), Modified: int(info.ModTime().Unix()), Versioned: int(time.Unix(0, versioned).Unix())})
+	}
+	slices.SortFunc(versions, func(a, b FileVersion) int {
+		return strings.Compare(b.ID, a.ID)
+	})
+	return versions, nil
+}
+
+func getVersionPath(rootPath string, fullPath string, id string) (string, error) {
+	versionsPath, err := getVersionsPath(rootPath, fullPath)
+	if err != nil {
+		return "", err
+	}
+	if _, parseErr := strconv.ParseInt(id, 10, 64); parseErr != nil {
+		return "", newError(codeBadRequest, "Invalid version id %s", id)
+	}
+	versionPath := filepath.Join(versionsPath, id)
+	info, statErr := os.Stat(versionPath)
+	if statErr != nil || !info.Mode().IsRegular() {
+		return "", newError(codeNotFound, "Version %s of %s not found", id, filepath.Base(fullPath))
+	}
+	return versionPath, nil
+}
+
+// ListVersions sends a JSON array of the saved versions of the file at
+// fullPath, newest first.
+func ListVersions(fullPath string, rootPath string, c chan<- string, cErr chan<- error) {
+	defer close(cErr)
+	defer close(c)
+
+	versionsPath, err := getVersionsPath(rootPath, fullPath)
+	if err != nil {
+		cErr <- err
+		return
+	}
+	versions, err := getVersions(versionsPath)
+	if err != nil {
+		cErr <- err
+		return
+	}
+	s, err := json.Marshal(versions)
+	if err != nil {
+		cErr <- fmt.Errorf("Error marshalling versions: %s", err.Error())
+		return
+	}
+	c <- string(s)
+}
+
+// ReadVersion streams the contents of one saved version of the file at fullPath.
+func ReadVersion(fullPath string, rootPath string, id string, cFile chan<- []byte, cErr chan<- error, chunkSize int) {
+	defer close(cErr)
+
+	versionPath, err := getVersionPath(rootPath, fullPath, id)
+	if err != nil {
+		close(cFile)
+		cErr <- err
+		return
+	}
+	file, err := os.Open(versionPath)
+	if err != nil {
+		close(cFile)
+		cErr <- fmt.Errorf("Error reading version: %w", err)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		close(cFile)
+		cErr <- fmt.Errorf("Error reading version: %w", err)
+		return
+	}
+	sendErr := sendFileChunks(file, info.Size(), cFile, chunkSize)
+	if sendErr != nil {
+		cErr <- sendErr
+	}
+}
+
+// RestoreVersion puts a saved version back in place of the file at fullPath.
+// The contents being replaced are kept as a version of their own, so a restore
+// can always be undone.
+func RestoreVersion(ctx context.Context, fullPath string, rootPath string, id string, retention VersionRetention, cResult chan<- string, cErr chan<- error) {
+	defer close(cErr)
+	defer close(cResult)
+
+	versionPath, err := getVersionPath(rootPath, fullPath, id)
+	if err != nil {
+		cErr <- err
+		return
+	}
+	version, err := os.Open(versionPath)
+	if err != nil {
+		cErr <- fmt.Errorf("Error reading version: %w", err)
+		return
+	}
+	defer version.Close()
+
+	target, writeErr := writeFileAtomic(filepath.Dir(fullPath), filepath.Base(fullPath), version, conflictOverwrite, rootPath, retention, "")
+	if writeErr != nil {
+		cErr <- writeErr
+		return
+	}
+	info, statErr := os.Stat(target)
+	if statErr != nil {
+		cErr <- statErr
+		return
+	}
+	auditBytes(ctx, info.Size())
+	s, err := json.Marshal(WrittenFile{Name: info.Name(), Size: int(info.Size()), ETag: getETag(info)})
+	if err != nil {
+		cErr <- fmt.Errorf("Error marshalling written file: %s", err.Error())
+		return
+	}
+	cResult <- string(s)
+	versionsLog.InfoContext(ctx, "restored version", "path", fullPath, "id", id)
+}
+
+// SweepVersions runs forever, applying the configured retention to every
+// version store so versions of files that are no longer written still age out.
+func SweepVersions(interval time.Duration) {
+	for ; ; time.Sleep(interval) {
+		settings := getSettings()
+		retention := settings.VersionRetention
+		if retention.MaxAge <= 0 {
+			continue
+		}
+		for _, rootPath := range settings.BasePaths {
+			versionsRoot := filepath.Join(rootPath, versionsDirName)
+			versionDirs := []string{}
+			filepath.WalkDir(versionsRoot, func(p string, d fs.DirEntry, err error) error {
+				if err == nil && d.IsDir() {
+					versionDirs = append(versionDirs, p)
+				}
+				return nil
+			})
+			// deepest first, so emptied parents can be cleared as well
+			for _, versionsPath := range slices.Backward(versionDirs) {
+				pruneErr := pruneVersions(versionsPath, retention)
+				if pruneErr != nil {
+					versionsLog.Error("error sweeping versions", "error", pruneErr)
+				}
+			}
+		}
+	}
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	_, copyErr := io.Copy(out, in)
+	if copyErr == nil {
+		copyErr = out.Sync()
+	}
+	closeErr := out.Close()
+	if copyErr != nil {
+		os.Remove(dst)
+		return copyErr
+	}
+	return closeErr
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchBatchInterval is how long the watcher gathers events before publishing
+// them, so a file being written in many pieces is only published once.
+const watchBatchInterval = 250 * time.Millisecond
+
+// Watcher publishes changes made to the roots by anything other than rnas,
+// watching every directory below them with inotify. Since inotify can drop
+// events when it falls behind, and has a limit on how many directories it
+// watches, the roots are also rescanned from scratch every so often.
+type Watcher struct {
+	watcher   *fsnotify.Watcher
+	basePaths map[string]string
+	dirs      map[string]bool // real paths of the watched directories
+	pending   []ChangeEvent
+}
+
+// WatchRoots runs forever, watching every root in basePaths and rescanning them
+// every rescanInterval, or never if it is 0.
+func WatchRoots(basePaths map[string]string, rescanInterval time.Duration) {
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		indexLog.Warn("error starting watcher, falling back on rescans", "error", err)
+		if rescanInterval > 0 {
+			for {
+				time.Sleep(rescanInterval)
+				rescanRoots()
+			}
+		}
+		return
+	}
+	defer fsWatcher.Close()
+
+	w := &Watcher{watcher: fsWatcher, basePaths: basePaths, dirs: map[string]bool{}}
+	for _, rootPath := range basePaths {
+		w.watchTree(filepath.Clean(rootPath))
+	}
+
+	batch := time.NewTicker(watchBatchInterval)
+	defer batch.Stop()
+	var rescan <-chan time.Time
+	if rescanInterval > 0 {
+		rescanTicker := time.NewTicker(rescanInterval)
+		defer rescanTicker.Stop()
+		rescan = rescanTicker.C
+	}
+
+	for {
+		select {
+		case event, ok := <-fsWatcher.Events:
+			if !ok {
+				return
+			}
+			w.handle(event)
+		case watchErr, ok := <-fsWatcher.Errors:
+			if !ok {
+				return
+			}
+			indexLog.Error("error watching roots", "error", watchErr)
+			if errors.Is(watchErr, fsnotify.ErrEventOverflow) {
+				w.pending = nil
+				w.rescan()
+			}
+		case basePaths := <-watchedRoots:
+			w.setRoots(basePaths)
+		case <-batch.C:
+			w.flush()
+		case <-rescan:
+			w.rescan()
+		}
+	}
+}
+
+// watchTree adds a watch on the directory at path and every directory below it.
+func (w *Watcher) watchTree(path string) {
+	filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if (p != path && isHiddenEntry(d.Name())) || isStreamOutput(p) {
+			return filepath.SkipDir
+		}
+		if w.dirs[p] {
+			return nil
+		}
+		addErr := w.watcher.Add(p)
+		if addErr != nil {
+			indexLog.Warn("error watching directory", "path", p, "error", addErr)
+			return nil
+		}
+		w.dirs[p] = true
+		return nil
+	})
+}
+
+// unwatchTree forgets the directory at path and every directory below it,
+// which inotify has either dropped already or would keep reporting under the
+// wrong name after a move.
+func (w *Watcher) unwatchTree(path string) {
+	prefix := path + string(filepath.Separator)
+	for dir := range w.dirs {
+		if dir == path || strings.HasPrefix(dir, prefix) {
+			w.watcher.Remove(dir)
+			delete(w.dirs, dir)
+		}
+	}
+}
+
+func (w *Watcher) handle(event fsnotify.Event) {
+	path := filepath.Clean(event.Name)
+	if w.isHidden(path) {
+		return
+	}
+	isDir := w.dirs[path]
+	switch {
+	case event.Has(fsnotify.Create):
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			isDir = true
+			w.watchTree(path)
+		}
+		w.pending = append(w.pending, ChangeEvent{Type: changeCreate, Path: path, Dir: isDir})
+	case event.Has(fsnotify.Write):
+		w.pending = append(w.pending, ChangeEvent{Type: changeModify, Path: path})
+	case event.Has(fsnotify.Remove):
+		w.unwatchTree(path)
+		w.pending = append(w.pending, ChangeEvent{Type: changeDelete, Path: path, Dir: isDir})
+	case event.Has(fsnotify.Rename):
+		w.unwatchTree(path)
+		w.pending = append(w.pending, ChangeEvent{Type: changeRename, OldPath: path, Dir: isDir})
+	}
+}
+
+// isHidden reports whether path is a root's internal files, transcoded video
+// kept inside a root, or outside the roots altogether.
+func (w *Watcher) isHidden(path string) bool {
+	_, rootPath, ok := getRootOf(w.basePaths, path)
+	if !ok || isStreamOutput(path) {
+		return true
+	}
+	rel, err := filepath.Rel(rootPath, path)
+	if err != nil {
+		return true
+	}
+	return slices.ContainsFunc(strings.Split(filepath.ToSlash(rel), "/"), isHiddenEntry)
+}
+
+// isStreamOutput reports whether path is in the streamable path, which may be
+// inside a root but only ever changes as videos are transcoded.
+func isStreamOutput(path string) bool {
+	streamablePath := getSettings().StreamablePath
+	if streamablePath == "" {
+		return false
+	}
+	streamablePath = filepath.Clean(streamablePath)
+	return path == streamablePath || strings.HasPrefix(path, streamablePath+string(filepath.Separator))
+}
+
+// flush publishes the events gathered since the last flush. inotify reports a
+// move as the old name going away followed by the new one appearing, so each
+// rename is paired with the first entry created after it, preferring one with
+// the same name. A rename with nothing to pair it with has left the roots and
+// is published as a delete. Repeats of an event already in the batch are
+// dropped, as are changes the API has already published.
+func (w *Watcher) flush() {
+	if len(w.pending) == 0 {
+		return
+	}
+	events := w.pending
+	w.pending = nil
+
+	paired := map[int]bool{}
+	for i, e := range events {
+		if e.Type != changeRename {
+			continue
+		}
+		match := -1
+		for j := i + 1; j < len(events); j++ {
+			created := events[j]
+			if paired[j] || created.Type != changeCreate || created.Dir != e.Dir {
+				continue
+			}
+			if filepath.Base(created.Path) == filepath.Base(e.OldPath) {
+				match = j
+				break
+			}
+			if match < 0 {
+				match = j
+			}
+		}
+		if match < 0 {
+			events[i] = ChangeEvent{Type: changeDelete, Path: e.OldPath, Dir: e.Dir}
+			continue
+		}
+		paired[match] = true
+		events[i].Path = events[match].Path
+	}
+
+	published := map[ChangeEvent]bool{}
+	for i, e := range events {
+		if paired[i] || published[e] {
+			continue
+		}
+		published[e] = true
+		if changedRecently(e.Path) || (e.OldPath != "" && changedRecently(e.OldPath)) {
+			continue
+		}
+		changeBus.Publish(e)
+	}
+}
+
+// watchedRoots hands the watcher new roots when the config is reloaded.
+var watchedRoots = make(chan map[string]string, 1)
+
+// setWatchedRoots has the watcher watch basePaths from now on, replacing any
+// roots it hasn't picked up yet.
+func setWatchedRoots(basePaths map[string]string) {
+	select {
+	case <-watchedRoots:
+	default:
+	}
+	watchedRoots <- basePaths
+}
+
+// setRoots stops watching roots that have gone and starts on new ones.
+func (w *Watcher) setRoots(basePaths map[string]string) {
+	for rootName, rootPath := range w.basePaths {
+		if basePaths[rootName] != rootPath {
+			w.unwatchTree(filepath.Clean(rootPath))
+		}
+	}
+	w.basePaths = basePaths
+	for _, rootPath := range basePaths {
+		w.watchTree(filepath.Clean(rootPath))
+	}
+}
+
+// rescan walks every root again, picking up anything the watcher missed.
+func (w *Watcher) rescan() {
+	for _, rootPath := range w.basePaths {
+		w.watchTree(filepath.Clean(rootPath))
+	}
+	go rescanRoots()
+}
+
+var rescanLock = sync.Mutex{}
+
+// rescanRoots rebuilds the indexes and quota counts and empties the caches,
+// for when changes to the roots may have gone unseen. It does nothing if a
+// rescan is already running.
+func rescanRoots() {
+	if !rescanLock.TryLock() {
+		return
+	}
+	defer rescanLock.Unlock()
+	clearUsage()
+	quotas.Recount()
+	fileIndex.Rebuild()
+	contentIndex.Rebuild()
+}
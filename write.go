@@ -1,21 +1,66 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 )
 
 type File struct {
 	Name  string `json:"name"`
 	Type  string `json:"type"`
 	Bytes []byte `json:"bytes"`
+	// ETag is the file's own If-Match precondition when overwriting, for
+	// batches where one If-Match header can't speak for every file.
+	ETag string `json:"etag,omitempty"`
 }
 
-func Write(fullPath string, body io.ReadCloser, cErr chan error, chunkSize int) {
-	fmt.Println("hit write")
+type WrittenFile struct {
+	Name string `json:"name"`
+	Size int    `json:"size"`
+	ETag string `json:"etag"`
+}
+
+// Conflict policies for uploads whose name is already taken.
+const (
+	conflictError     = "error"
+	conflictOverwrite = "overwrite"
+	conflictRename    = "rename"
+)
+
+// uploadTempPrefix marks in-progress uploads, which are hidden from listings
+// until they are renamed into place.
+const uploadTempPrefix = ".rnas-upload-"
+
+// Write stores every file in the JSON body in the directory at fullPath. Each
+// file is written to a temp file, synced and then moved into place, so a
+// failed upload never leaves a truncated file behind. conflict decides what
+// happens when a name is taken, and overwrites must name the current ETag of
+// every file they replace, either in ifMatch (or "*") for a single file or in
+// each file's own etag. Every precondition is checked before anything is
+// written, so a stale ETag turns down the whole batch. Overwritten contents
+// are kept in the root's version store. The batch is turned down if it would
+// take the root, or user, over quota. If accept is given, it sees the whole
+// batch before anything is written and can turn it down too.
+func Write(ctx context.Context, fullPath string, rootPath string, body io.ReadCloser, conflict string, ifMatch []string, retention VersionRetention, user string, accept func([]File) error, cResult chan<- string, cErr chan error, chunkSize int) {
 	defer close(cErr)
+	defer close(cResult)
+
+	if conflict == "" {
+		conflict = conflictError
+	}
+	if !slices.Contains([]string{conflictError, conflictOverwrite, conflictRename}, conflict) {
+		cErr <- newError(codeBadRequest, "Unknown conflict policy %s", conflict)
+		return
+	}
 
 	bodyBytes, readErr := io.ReadAll(body)
 	if readErr != nil {
@@ -23,43 +68,219 @@ func Write(fullPath string, body io.ReadCloser, cErr chan error, chunkSize int)
 		return
 	}
 	body.Close()
-	fmt.Println("read body")
 	files := []File{}
 	jsonErr := json.Unmarshal(bodyBytes, &files)
 	if jsonErr != nil {
-		cErr <- jsonErr
+		cErr <- newError(codeBadRequest, "Error parsing uploaded files: %s", jsonErr.Error())
 		return
 	}
-	fmt.Println("got", len(files), "files:")
+	filesLog.DebugContext(ctx, "writing files", "dir", fullPath, "count", len(files))
 
-	dir, dirErr := os.ReadDir(fullPath)
+	dirInfo, dirErr := os.Stat(fullPath)
 	if dirErr != nil {
 		cErr <- dirErr
 		return
 	}
+	if !dirInfo.IsDir() {
+		cErr <- newError(codeBadRequest, "%s is not a directory", clientPath(fullPath))
+		return
+	}
+
+	if len(files) > 1 && len(ifMatch) > 0 && slices.ContainsFunc(files, func(f File) bool { return f.ETag == "" }) {
+		cErr <- newError(codeBadRequest, "If-Match can only guard a single file, give each file its own etag")
+		return
+	}
 	for _, f := range files {
-		fileName := f.Name
-		fmt.Println(fileName)
-		for _, dirEntry := range dir {
-			if dirEntry.Name() == fileName {
-				err := fmt.Errorf("File with name %s already exists in directory", fileName)
-				cErr <- err
+		if f.Name == "" || f.Name == "." || f.Name == ".." || strings.ContainsAny(f.Name, `/\`) || isHiddenEntry(f.Name) {
+			cErr <- newError(codeBadRequest, "Invalid file name %s", f.Name)
+			return
+		}
+	}
+	if conflict == conflictOverwrite {
+		// the check and the rename below are not atomic, so a file changed
+		// in between is still overwritten, the same as any other last write
+		for _, f := range files {
+			tags := ifMatch
+			if f.ETag != "" {
+				tags = parseIfMatch(f.ETag)
+			}
+			if len(tags) == 0 {
+				cErr <- newError(codePreconditionFailed, "Overwriting %s requires an If-Match header or etag", f.Name)
+				return
+			}
+			matchErr := checkIfMatch(filepath.Join(fullPath, f.Name), tags)
+			if matchErr != nil {
+				cErr <- matchErr
 				return
 			}
 		}
-
-		file, createErr := os.Create(fullPath + fileName)
-		if createErr != nil {
-			cErr <- createErr
+	}
+	// overwrites only count by how much they change the size of the file
+	// they replace, and add no file
+	total, added, newFiles := int64(0), int64(0), 0
+	for _, f := range files {
+		total += int64(len(f.Bytes))
+		if conflict == conflictOverwrite {
+			old, oldErr := os.Stat(filepath.Join(fullPath, f.Name))
+			if oldErr == nil && old.Mode().IsRegular() {
+				added += int64(len(f.Bytes)) - old.Size()
+				continue
+			}
+		}
+		added += int64(len(f.Bytes))
+		newFiles++
+	}
+	quotaErr := quotas.Check(rootPath, user, added, newFiles)
+	if quotaErr != nil {
+		cErr <- quotaErr
+		return
+	}
+	if accept != nil {
+		acceptErr := accept(files)
+		if acceptErr != nil {
+			cErr <- acceptErr
 			return
 		}
-		defer file.Close()
-		_, writeErr := file.Write(f.Bytes)
+	}
+
+	uploaded := bytesUploaded.WithLabelValues(rootNameOf(rootPath))
+	written := []WrittenFile{}
+	for _, f := range files {
+		fileName := f.Name
+		filesLog.DebugContext(ctx, "writing file", "name", fileName, "size", len(f.Bytes))
+
+		target, writeErr := writeFileAtomic(fullPath, fileName, bytes.NewReader(f.Bytes), conflict, rootPath, retention, user)
 		if writeErr != nil {
 			cErr <- writeErr
 			return
 		}
+		info, statErr := os.Stat(target)
+		if statErr != nil {
+			cErr <- statErr
+			return
+		}
+		uploaded.Add(float64(len(f.Bytes)))
+		auditBytes(ctx, int64(len(f.Bytes)))
+		auditDetail(ctx, "wrote "+info.Name())
+		written = append(written, WrittenFile{Name: info.Name(), Size: int(info.Size()), ETag: getETag(info)})
+	}
+
+	s, err := json.Marshal(written)
+	if err != nil {
+		cErr <- fmt.Errorf("Error marshalling written files: %s", err.Error())
+		return
+	}
+	cResult <- string(s)
+	filesLog.InfoContext(ctx, "wrote files", "dir", fullPath, "count", len(written), "bytes", total)
+}
+
+// writeFileAtomic writes data to a temp file in dir and moves it to fileName
+// once it is safely on disk, returning the path it ended up at. The new file
+// counts towards owner's quota, if there is an owner.
+func writeFileAtomic(dir string, fileName string, data io.Reader, conflict string, rootPath string, retention VersionRetention, owner string) (string, error) {
+	tmp, createErr := os.CreateTemp(dir, uploadTempPrefix+"*")
+	if createErr != nil {
+		return "", createErr
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	size, writeErr := io.Copy(tmp, data)
+	if writeErr == nil {
+		writeErr = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if writeErr != nil {
+		return "", writeErr
+	}
+	if closeErr != nil {
+		return "", closeErr
+	}
+	chmodErr := os.Chmod(tmpPath, 0666)
+	if chmodErr != nil {
+		return "", chmodErr
+	}
+
+	target := filepath.Join(dir, fileName)
+	if conflict == conflictOverwrite {
+		old, oldErr := os.Stat(target)
+		versionErr := saveVersion(rootPath, target, retention)
+		if versionErr != nil {
+			return "", versionErr
+		}
+		renameErr := os.Rename(tmpPath, target)
+		if renameErr != nil {
+			return "", renameErr
+		}
+		if oldErr == nil && old.Mode().IsRegular() {
+			quotas.Replaced(target, owner, size, old.Size())
+		} else {
+			quotas.Added(target, owner, size)
+		}
+		notifyChanged(changeModify, target)
+		return target, syncDir(dir)
 	}
 
-	fmt.Println("File should now be available at ", fullPath)
+	// linking rather than renaming fails if the name was taken in the meantime,
+	// so nothing is ever clobbered without an explicit overwrite
+	for n := 1; ; n++ {
+		linkErr := os.Link(tmpPath, target)
+		if linkErr == nil {
+			break
+		}
+		if !errors.Is(linkErr, fs.ErrExist) {
+			return "", linkErr
+		}
+		if conflict != conflictRename {
+			return "", newError(codeConflict, "File with name %s already exists in directory", fileName)
+		}
+		target = filepath.Join(dir, getRenamedFileName(fileName, n))
+	}
+	quotas.Added(target, owner, size)
+	notifyChanged(changeCreate, target)
+	return target, syncDir(dir)
+}
+
+// getRenamedFileName returns the nth alternative for a taken name, in the
+// style of "name (1).ext".
+func getRenamedFileName(fileName string, n int) string {
+	ext := filepath.Ext(fileName)
+	base := strings.TrimSuffix(fileName, ext)
+	if base == "" {
+		base, ext = fileName, ""
+	}
+	return fmt.Sprintf("%s (%d)%s", base, n, ext)
+}
+
+func checkIfMatch(path string, ifMatch []string) error {
+	info, statErr := os.Stat(path)
+	if statErr != nil {
+		return newError(codePreconditionFailed, "File %s does not exist", filepath.Base(path))
+	}
+	if slices.Contains(ifMatch, "*") || slices.Contains(ifMatch, getETag(info)) {
+		return nil
+	}
+	return newError(codePreconditionFailed, "File %s has been modified", filepath.Base(path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// parseIfMatch splits an If-Match header into its entity tags. Weak tags are
+// compared as if they were strong.
+func parseIfMatch(header string) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParseIfMatch(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{``, []string{}},
+		{`*`, []string{"*"}},
+		{`"a"`, []string{`"a"`}},
+		{`"a", "b"`, []string{`"a"`, `"b"`}},
+		{`W/"a",W/"b"`, []string{`"a"`, `"b"`}},
+		{` , "a" ,`, []string{`"a"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			if got := parseIfMatch(tt.header); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckIfMatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(path, []byte("contents"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := getETag(info)
+
+	tests := []struct {
+		name    string
+		path    string
+		ifMatch []string
+		wantErr bool
+	}{
+		{"current etag", path, []string{etag}, false},
+		{"one of several", path, []string{`"stale"`, etag}, false},
+		{"any", path, []string{"*"}, false},
+		{"stale etag", path, []string{`"stale"`}, true},
+		{"none", path, []string{}, true},
+		{"missing file", filepath.Join(dir, "missing.txt"), []string{"*"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkIfMatch(tt.path, tt.ifMatch)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got %v, want an error: %v", err, tt.wantErr)
+			}
+			if err != nil && getErrorCode(err) != codePreconditionFailed {
+				t.Errorf("got code %s, want %s", getErrorCode(err), codePreconditionFailed)
+			}
+		})
+	}
+}